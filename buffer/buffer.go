@@ -2,13 +2,29 @@ package buffer
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
 )
 
+var (
+	ErrQueueFull = errors.New("Buffer queue is full")
+	ErrClosed    = errors.New("Buffer is closed")
+	// Returned by pushes which would block after Interrupt
+	ErrInterrupted = errors.New("Buffer is interrupted")
+	errDropped     = errors.New("dropped")
+)
+
+// Logger is used to report buffer events. *log.Logger satisfies it.
+type Logger interface {
+	Warningf(string, ...interface{})
+}
+
 type StringItem string
 
 func (s StringItem) Size() int64 {
@@ -33,11 +49,81 @@ type Handler interface {
 	Write([]Sizer) (int, error)
 }
 
+// Discarder is optionally implemented by a Handler to receive items which
+// couldn't be written within the retry limit. It returns the number of items
+// actually dropped.
+type Discarder interface {
+	Discard([]Sizer) int
+}
+
+// Dropper is optionally implemented by a Handler to be notified of items
+// dropped by the overflow action. It's called inside the lock of the buffer.
+type Dropper interface {
+	Dropped([]Sizer)
+}
+
+// MetadataHandler is optionally implemented by a Handler to receive the
+// metadata of the chunk being written.
+type MetadataHandler interface {
+	WriteWithMetadata(*Metadata, []Sizer) (int, error)
+}
+
+// CompressedHandler is optionally implemented by a Handler to receive
+// compressed chunks as they are. Items are decompressed before written to
+// handlers not accepting the format.
+type CompressedHandler interface {
+	AcceptCompressed(Compression) bool
+	WriteCompressed(*Metadata, *CompressedItem) error
+}
+
+type Buffer interface {
+	Push(Sizer) error
+	PushWithMetadata(*Metadata, Sizer) error
+	Stats() *Stats
+	Usage() float64
+	Interrupt()
+	Close()
+}
+
+// Stats describes the state of a buffer. TotalSize includes chunks being
+// written.
+type Stats struct {
+	QueuedChunks int   `codec:"queued_chunks"`
+	StagedChunks int   `codec:"staged_chunks"`
+	TotalSize    int64 `codec:"total_size"`
+	LimitSize    int64 `codec:"limit_size"`
+	Dropped      int64 `codec:"dropped"`
+	// Retries counts failed writes, NextRetry is the earliest time to retry
+	// the chunks being retried
+	Retries   int64      `codec:"retries"`
+	NextRetry *time.Time `codec:"next_retry"`
+	// Time taken to write chunks in seconds, including failed attempts
+	FlushLatency *Histogram `codec:"flush_latency"`
+}
+
+// New creates a buffer of the type specified in opts.
+func New(opts *Options, h Handler, l Logger) (Buffer, error) {
+	switch opts.Type {
+	case "memory":
+		return NewMemory(opts, h, l), nil
+	case "file":
+		return NewFile(opts, h, l)
+	}
+	return nil, fmt.Errorf("Unknown buffer type: %s", opts.Type)
+}
+
 type ChunkHandler func(c Chunk) error
 
 type MemoryChunk struct {
-	Size  int64
-	Items []Sizer
+	Size     int64
+	Items    []Sizer
+	Metadata *Metadata
+	seq      uint64
+	created  time.Time
+
+	// Retry state, guarded by the lock of Memory
+	retries   int
+	nextRetry time.Time
 }
 
 func (m *MemoryChunk) Push(s Sizer) {
@@ -45,64 +131,460 @@ func (m *MemoryChunk) Push(s Sizer) {
 	m.Items = append(m.Items, s)
 }
 
+// compressed returns the compressed item if the chunk is compressed.
+func (m *MemoryChunk) compressed() (*CompressedItem, bool) {
+	if len(m.Items) != 1 {
+		return nil, false
+	}
+	ci, ok := m.Items[0].(*CompressedItem)
+	return ci, ok
+}
+
+// Consume removes first n items which are already written.
+func (m *MemoryChunk) Consume(n int) {
+	for _, s := range m.Items[:n] {
+		m.Size -= s.Size()
+	}
+	n = copy(m.Items, m.Items[n:])
+	m.Items = m.Items[:n]
+}
+
+// chunkStore persists chunks held by Memory. Each method is called when the
+// corresponding state change happens to the chunk.
+type chunkStore interface {
+	Create(*MemoryChunk) error
+	Append(*MemoryChunk, Sizer) error
+	Enqueue(*MemoryChunk) error
+	Update(*MemoryChunk) error
+	Remove(*MemoryChunk) error
+	Close(*MemoryChunk) error
+}
+
+type nopStore struct{}
+
+func (nopStore) Create(*MemoryChunk) error        { return nil }
+func (nopStore) Append(*MemoryChunk, Sizer) error { return nil }
+func (nopStore) Enqueue(*MemoryChunk) error       { return nil }
+func (nopStore) Update(*MemoryChunk) error        { return nil }
+func (nopStore) Remove(*MemoryChunk) error        { return nil }
+func (nopStore) Close(*MemoryChunk) error         { return nil }
+
 type Memory struct {
+	staged           map[string]*MemoryChunk
 	chunks           *list.List
+	seq              uint64
 	maxChunkSize     int64
 	maxQueueSize     int64
+	overflowAction   OverflowAction
+	compression      Compression
+	flushMode        FlushMode
 	flushInterval    time.Duration
+	flushAtShutdown  bool
+	timekey          time.Duration
+	timekeyWait      time.Duration
 	retryInterval    time.Duration
 	maxRetryInterval time.Duration
+	retryLimit       int
+	retryTimeout     time.Duration
+	flushThreads     int
+	orderedFlush     bool
+	flushing         map[string]bool
 	handler          Handler
+	store            chunkStore
+	log              Logger
+	dropped          int64
+	retries          int64
+	retrying         map[*MemoryChunk]bool
+	flushLatency     *Histogram
+	unreported       int64
+	reportedAt       time.Time
+	local            *limiter
+	global           *limiter
 	awake            chan struct{}
-	closed           chan struct{}
-	m                sync.Mutex
+	interrupted      chan struct{}
+	// Pushes waiting for a room
+	blocked       int
+	interruptOnce sync.Once
+	resched       chan struct{}
+	closed        chan struct{}
+	wg            sync.WaitGroup
+	m             sync.Mutex
 }
 
-func NewMemory(opts *Options, h Handler) *Memory {
+func NewMemory(opts *Options, h Handler, l Logger) *Memory {
+	m := newMemory(opts, h, l, nopStore{})
+	m.start()
+	return m
+}
+
+func newMemory(opts *Options, h Handler, l Logger, store chunkStore) *Memory {
 	m := &Memory{
+		staged:           make(map[string]*MemoryChunk),
+		retrying:         make(map[*MemoryChunk]bool),
+		flushLatency:     newHistogram(FlushLatencyBounds),
 		chunks:           list.New(),
 		maxChunkSize:     int64(opts.MaxChunkSize),
 		maxQueueSize:     int64(opts.MaxQueueSize),
+		overflowAction:   opts.OverflowAction,
+		compression:      opts.Compress,
+		flushMode:        opts.flushMode(),
 		flushInterval:    time.Duration(opts.FlushInterval),
+		flushAtShutdown:  opts.FlushAtShutdown == nil || *opts.FlushAtShutdown,
+		timekey:          time.Duration(opts.Timekey),
+		timekeyWait:      time.Duration(opts.TimekeyWait),
 		retryInterval:    time.Duration(opts.RetryInterval),
 		maxRetryInterval: time.Duration(opts.MaxRetryInterval),
+		retryLimit:       opts.RetryLimit,
+		retryTimeout:     time.Duration(opts.RetryTimeout),
+		flushThreads:     opts.FlushThreadCount,
+		orderedFlush:     opts.OrderedFlush,
+		flushing:         make(map[string]bool),
 		handler:          h,
+		store:            store,
+		log:              l,
+		local:            newLimiter(int64(opts.TotalLimitSize)),
+		global:           globalLimiter,
 		awake:            make(chan struct{}, 1),
+		interrupted:      make(chan struct{}),
+		resched:          make(chan struct{}, 1),
 		closed:           make(chan struct{}),
 	}
-	go m.pop()
+	if m.flushThreads < 1 {
+		m.flushThreads = 1
+	}
+	if m.flushMode == FlushModeInterval && m.flushInterval <= 0 {
+		m.flushMode = FlushModeImmediate
+	}
+	if opts.GlobalLimitSize > 0 {
+		m.global.setLimit(int64(opts.GlobalLimitSize))
+	}
 	return m
 }
 
 func (m *Memory) Push(s Sizer) error {
+	return m.PushWithMetadata(nil, s)
+}
+
+// PushWithMetadata pushes the item into the chunk for the metadata. Items
+// with different metadata never share the same chunk.
+func (m *Memory) PushWithMetadata(meta *Metadata, s Sizer) error {
 	n := s.Size()
 	if n > m.maxChunkSize {
 		return fmt.Errorf("Too large item: %d, max: %d", n, m.maxChunkSize)
 	}
+	err := m.push(meta, s, n)
+	m.report(false)
+	return err
+}
+
+func (m *Memory) push(meta *Metadata, s Sizer, n int64) error {
 	m.m.Lock()
 	defer m.m.Unlock()
 
-	e := m.chunks.Front()
-	if e == nil || e.Value.(*MemoryChunk).Size+n > m.maxChunkSize {
-		if e != nil {
+	// The staging decision is made again after reserve waited for a room,
+	// since the staged chunk may be grown or moved to the queue meanwhile.
+	key := meta.Key()
+	var c *MemoryChunk
+	for {
+		c = m.staged[key]
+		create := c == nil || c.Size+n > m.maxChunkSize
+		if create && c != nil {
+			m.enqueue(c)
 			m.notify()
+			c = nil
+		}
+		full, wait := m.full(n, create)
+		if !full {
+			break
+		}
+		if err := m.reserve(wait); err != nil {
+			if err == errDropped {
+				m.dropItems([]Sizer{s})
+				return nil
+			}
+			return err
 		}
+	}
 
-		e = m.chunks.PushFront(&MemoryChunk{})
-		if int64(m.chunks.Len()) > m.maxQueueSize {
-			m.chunks.Remove(m.chunks.Back())
+	if c == nil {
+		c = m.newChunk(meta)
+		if err := m.store.Create(c); err != nil {
+			return err
+		}
+		m.staged[key] = c
+		if m.flushMode == FlushModeAligned || m.flushMode == FlushModeLazy {
+			m.reschedule()
 		}
 	}
 
-	e.Value.(*MemoryChunk).Push(s)
-	if m.flushInterval == 0 {
+	if err := m.store.Append(c, s); err != nil {
+		return err
+	}
+	c.Push(s)
+	m.local.acquire(n)
+	m.global.acquire(n)
+	if m.flushMode == FlushModeImmediate {
 		m.notify()
 	}
 	return nil
 }
 
+// newChunk creates a chunk. This function assumes called inside locked block.
+func (m *Memory) newChunk(meta *Metadata) *MemoryChunk {
+	m.seq++
+	return &MemoryChunk{Metadata: meta, seq: m.seq, created: time.Now()}
+}
+
+// enqueue moves the staged chunk to the queue. This function assumes called
+// inside locked block.
+func (m *Memory) enqueue(c *MemoryChunk) {
+	compressed := m.compress(c)
+	m.store.Enqueue(c)
+	if compressed {
+		m.store.Update(c)
+	}
+	m.chunks.PushFront(c)
+	delete(m.staged, c.Metadata.Key())
+}
+
+// compress replaces the items of the chunk with a compressed item. The chunk
+// is left as is if it can't be compressed or the result is not smaller.
+func (m *Memory) compress(c *MemoryChunk) bool {
+	if m.compression == CompressNone || len(c.Items) == 0 {
+		return false
+	}
+	ci, err := compressItems(m.compression, c.Items)
+	if err != nil || ci == nil || ci.Size() >= c.Size {
+		return false
+	}
+	size := c.Size
+	c.Items = []Sizer{ci}
+	c.Size = ci.Size()
+	m.free(size - c.Size)
+	return true
+}
+
+// decompress restores the original items of the compressed chunk.
+func (m *Memory) decompress(c *MemoryChunk) error {
+	ci, ok := c.compressed()
+	if !ok {
+		return nil
+	}
+	items, err := ci.Items()
+	if err != nil {
+		return err
+	}
+	size := c.Size
+	c.Items, c.Size = nil, 0
+	for _, item := range items {
+		c.Push(item)
+	}
+	m.local.acquire(c.Size - size)
+	m.global.acquire(c.Size - size)
+	return nil
+}
+
+// enqueueStaged moves all staged chunks to the queue in creation order. This
+// function assumes called inside locked block.
+func (m *Memory) enqueueStaged() {
+	chunks := make([]*MemoryChunk, 0, len(m.staged))
+	for _, c := range m.staged {
+		chunks = append(chunks, c)
+	}
+	sort.Sort(bySeq(chunks))
+	for _, c := range chunks {
+		m.enqueue(c)
+	}
+}
+
+// full reports whether n more bytes can't be buffered. Unless the total
+// limit size is configured, the number of chunks is limited instead. If full,
+// the channel closed when the room may be made is returned as well. This
+// function assumes called inside locked block.
+func (m *Memory) full(n int64, create bool) (bool, <-chan struct{}) {
+	if ok, wait := m.global.tryOrWait(n); !ok {
+		return true, wait
+	}
+	if m.local.limit > 0 {
+		ok, wait := m.local.tryOrWait(n)
+		return !ok, wait
+	}
+	if create && int64(m.chunks.Len()+len(m.staged)+1) > m.maxQueueSize {
+		// Chunks leave the queue inside locked block, so no wakeup is lost
+		return true, m.local.wait()
+	}
+	return false, nil
+}
+
+// reserve takes the overflow action once to make a room. It returns nil if
+// the room may be made, then the caller checks it again. The block action
+// waits for the channel returned by full. This function assumes called
+// inside locked block.
+func (m *Memory) reserve(wait <-chan struct{}) error {
+	if m.overflowAction == OverflowBlock && m.isInterrupted() {
+		m.dropped++
+		return ErrInterrupted
+	}
+	switch m.overflowAction {
+	case OverflowDropOldest:
+		if m.chunks.Len() == 0 {
+			m.enqueueStaged()
+		}
+		if e := m.chunks.Back(); e != nil {
+			c := m.chunks.Remove(e).(*MemoryChunk)
+			m.store.Remove(c)
+			items := c.Items
+			n := len(items)
+			if ci, ok := c.compressed(); ok {
+				// Wrappers are enough for the handler to be notified
+				items, n = ci.Wrappers, ci.Len()
+			}
+			m.drop(n)
+			m.dropItems(items)
+			m.free(c.Size)
+			return nil
+		}
+		// All chunks are being written, nothing to drop but the new one
+		m.drop(1)
+		return errDropped
+	case OverflowDropNewest:
+		m.drop(1)
+		return errDropped
+	case OverflowBlock:
+		m.blocked++
+		m.m.Unlock()
+		var err error
+		select {
+		case <-wait:
+		case <-m.interrupted:
+			err = ErrInterrupted
+		case <-m.closed:
+			err = ErrClosed
+		}
+		m.m.Lock()
+		m.blocked--
+		if err == ErrInterrupted {
+			m.dropped++
+		}
+		return err
+	}
+	// OverflowError
+	m.dropped++
+	return ErrQueueFull
+}
+
+// Interrupt wakes up pushes blocked by the block overflow action, and makes
+// later pushes fail instead of blocking. Plugins call it before stopping, so
+// that they can read the stop message while the buffer is full.
+func (m *Memory) Interrupt() {
+	m.interruptOnce.Do(func() { close(m.interrupted) })
+}
+
+func (m *Memory) isInterrupted() bool {
+	select {
+	case <-m.interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// free releases n bytes from the limits.
+func (m *Memory) free(n int64) {
+	m.local.release(n)
+	m.global.release(n)
+}
+
+// drop counts dropped items. This function assumes called inside locked
+// block.
+func (m *Memory) drop(n int) {
+	m.dropped += int64(n)
+	m.unreported += int64(n)
+}
+
+func (m *Memory) dropItems(l []Sizer) {
+	if d, ok := m.handler.(Dropper); ok {
+		d.Dropped(l)
+	}
+}
+
+// report logs dropped items at most once per second unless forced, so that
+// the warnings themselves don't flood the buffer.
+func (m *Memory) report(force bool) {
+	m.m.Lock()
+	n, total := m.unreported, m.dropped
+	if n == 0 || (!force && time.Since(m.reportedAt) < time.Second) {
+		m.m.Unlock()
+		return
+	}
+	m.unreported = 0
+	m.reportedAt = time.Now()
+	m.m.Unlock()
+
+	if m.log != nil {
+		m.log.Warningf("Buffer overflow: %d items dropped (%d in total)", n, total)
+	}
+}
+
+// Dropped returns the number of items lost by the queue overflow or the
+// retry limit.
+func (m *Memory) Dropped() int64 {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.dropped
+}
+
+// Stats returns the current state of the buffer.
+func (m *Memory) Stats() *Stats {
+	m.m.Lock()
+	defer m.m.Unlock()
+	stats := &Stats{
+		QueuedChunks: m.chunks.Len(),
+		StagedChunks: len(m.staged),
+		TotalSize:    m.local.size(),
+		LimitSize:    m.local.limit,
+		Dropped:      m.dropped,
+		Retries:      m.retries,
+		FlushLatency: m.flushLatency.copy(),
+	}
+	for c := range m.retrying {
+		if stats.NextRetry == nil || c.nextRetry.Before(*stats.NextRetry) {
+			t := c.nextRetry
+			stats.NextRetry = &t
+		}
+	}
+	return stats
+}
+
+// Usage returns how full the buffer is, from 0 to 1. It's the ratio of bytes
+// to the size limits, or chunks to the queue size if no local limit is set.
+func (m *Memory) Usage() float64 {
+	u := m.global.usage()
+	if m.local.limit > 0 {
+		return math.Max(u, m.local.usage())
+	}
+	m.m.Lock()
+	n := m.chunks.Len() + len(m.staged)
+	m.m.Unlock()
+	return math.Max(u, float64(n)/float64(m.maxQueueSize))
+}
+
+// Close stops the buffer after trying to flush all chunks once.
 func (m *Memory) Close() {
 	close(m.closed)
+	m.wg.Wait()
+	// Chunks are left if every flush thread was retrying
+	m.shutdown()
+	m.report(true)
+}
+
+// shutdown flushes or closes the remaining chunks by flush_at_shutdown.
+func (m *Memory) shutdown() {
+	if m.flushAtShutdown {
+		m.flushChunks()
+	} else {
+		m.closeChunks()
+	}
 }
 
 func (m *Memory) notify() {
@@ -112,14 +594,25 @@ func (m *Memory) notify() {
 	}
 }
 
+// start starts flush threads.
+func (m *Memory) start() {
+	for i := 0; i < m.flushThreads; i++ {
+		m.wg.Add(1)
+		go m.pop()
+	}
+	if m.flushMode != FlushModeImmediate {
+		m.wg.Add(1)
+		go m.schedule()
+	}
+}
+
 func (m *Memory) pop() {
-	tick := time.Tick(m.flushInterval)
+	defer m.wg.Done()
 	for {
 		select {
-		case <-tick:
 		case <-m.awake:
 		case <-m.closed:
-			m.flushChunks()
+			m.shutdown()
 			return
 		}
 
@@ -127,56 +620,291 @@ func (m *Memory) pop() {
 		if chunk == nil {
 			continue
 		}
-		if n > 1 {
+		if n > 0 {
 			m.notify()
 		}
 
-		bt := backOffTick(m.retryInterval, m.maxRetryInterval)
-		for {
-			select {
-			case <-bt.C:
-			case <-m.closed:
-				return
-			}
+		ok := m.write(chunk)
+		m.release(chunk)
+		if !ok {
+			// Closed while retrying, the rest is left to the shutdown path
+			return
+		}
+	}
+}
 
-			n, err := m.handler.Write(chunk.Items)
-			if err == nil {
-				bt.Stop()
-				break
-			}
-			if n > 0 {
-				n = copy(chunk.Items, chunk.Items[n:])
-				chunk.Items = chunk.Items[:n]
+func (m *Memory) reschedule() {
+	select {
+	case m.resched <- struct{}{}:
+	default:
+	}
+}
+
+// schedule moves staged chunks to the queue when they are due.
+func (m *Memory) schedule() {
+	defer m.wg.Done()
+	var wait time.Duration
+	for {
+		var timer <-chan time.Time
+		if wait >= 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-timer:
+		case <-m.resched:
+		case <-m.closed:
+			return
+		}
+
+		m.m.Lock()
+		var n int
+		n, wait = m.enqueueDue(time.Now())
+		m.m.Unlock()
+		if n > 0 {
+			m.notify()
+		}
+	}
+}
+
+// enqueueDue enqueues staged chunks which are due at now. It returns the
+// number of enqueued chunks and the duration until the next chunk is due, or
+// -1 if nothing is scheduled. This function assumes called inside locked
+// block.
+func (m *Memory) enqueueDue(now time.Time) (int, time.Duration) {
+	if m.flushMode == FlushModeInterval {
+		n := len(m.staged)
+		m.enqueueStaged()
+		return n, m.flushInterval
+	}
+
+	var due []*MemoryChunk
+	next := time.Duration(-1)
+	for _, c := range m.staged {
+		if m.flushMode == FlushModeLazy && (c.Metadata == nil || c.Metadata.Timekey.IsZero()) {
+			// Lazy chunks without a time slice wait until full
+			continue
+		}
+		if d := m.deadline(c).Sub(now); d <= 0 {
+			due = append(due, c)
+		} else if next < 0 || d < next {
+			next = d
+		}
+	}
+	sort.Sort(bySeq(due))
+	for _, c := range due {
+		m.enqueue(c)
+	}
+	return len(due), next
+}
+
+// deadline returns the time when the chunk is flushed in aligned or lazy
+// mode. A time-sliced chunk is due after its slice is closed and the timekey
+// wait is elapsed. Others are due at the boundary of the flush interval.
+func (m *Memory) deadline(c *MemoryChunk) time.Time {
+	if c.Metadata != nil && !c.Metadata.Timekey.IsZero() {
+		return c.Metadata.Timekey.Add(m.timekey + m.timekeyWait)
+	}
+	slice := m.flushInterval
+	if slice <= 0 {
+		slice = m.timekey
+	}
+	return c.created.Truncate(slice).Add(slice)
+}
+
+// write writes the chunk with retrying until it succeeds or the retry limit
+// is reached. It returns false if the buffer is closed while retrying.
+func (m *Memory) write(chunk *MemoryChunk) bool {
+	defer func() {
+		m.m.Lock()
+		delete(m.retrying, chunk)
+		m.m.Unlock()
+	}()
+	start := time.Now()
+	b := newBackOff(m.retryInterval, m.maxRetryInterval)
+	for {
+		t := time.Now()
+		n, err := m.writeChunk(chunk)
+		m.m.Lock()
+		m.flushLatency.observe(time.Since(t))
+		m.m.Unlock()
+		if err == nil {
+			m.store.Remove(chunk)
+			m.free(chunk.Size)
+			return true
+		}
+		if n > 0 {
+			size := chunk.Size
+			chunk.Consume(n)
+			m.store.Update(chunk)
+			m.free(size - chunk.Size)
+		}
+
+		if (m.retryLimit > 0 && chunk.retries >= m.retryLimit) ||
+			(m.retryTimeout > 0 && time.Since(start) >= m.retryTimeout) {
+			m.giveUp(chunk, err)
+			return true
+		}
+
+		wait := b.NextBackOff()
+		m.m.Lock()
+		chunk.retries++
+		chunk.nextRetry = time.Now().Add(wait)
+		m.retries++
+		m.retrying[chunk] = true
+		m.m.Unlock()
+
+		select {
+		case <-time.After(wait):
+		case <-m.closed:
+			m.store.Close(chunk)
+			m.free(chunk.Size)
+			return false
+		}
+	}
+}
+
+// giveUp passes the chunk to the handler's Discard if implemented, otherwise
+// the items are dropped.
+func (m *Memory) giveUp(chunk *MemoryChunk, err error) {
+	if derr := m.decompress(chunk); derr != nil {
+		err = derr
+	}
+	n := len(chunk.Items)
+	if d, ok := m.handler.(Discarder); ok {
+		n = d.Discard(chunk.Items)
+	}
+	m.store.Remove(chunk)
+	m.free(chunk.Size)
+	if n == 0 {
+		return
+	}
+
+	m.m.Lock()
+	m.dropped += int64(n)
+	m.m.Unlock()
+	if m.log != nil {
+		m.log.Warningf("Retry limit exceeded: %d items dropped, last error: %v", n, err)
+	}
+}
+
+func (m *Memory) writeChunk(c *MemoryChunk) (int, error) {
+	if ci, ok := c.compressed(); ok {
+		if h, ok := m.handler.(CompressedHandler); ok && h.AcceptCompressed(ci.Format) {
+			if err := h.WriteCompressed(c.Metadata, ci); err != nil {
+				return 0, err
 			}
+			return 1, nil
+		}
+		if err := m.decompress(c); err != nil {
+			return 0, err
 		}
 	}
+	if h, ok := m.handler.(MetadataHandler); ok {
+		return h.WriteWithMetadata(c.Metadata, c.Items)
+	}
+	return m.handler.Write(c.Items)
 }
 
+// popChunk takes the oldest chunk from the queue. If ordered flush is
+// enabled, chunks whose key is being written by another thread are skipped
+// so that chunks of the same key are written one by one in order.
 func (m *Memory) popChunk() (*MemoryChunk, int) {
 	m.m.Lock()
 	defer m.m.Unlock()
-	e := m.chunks.Back()
-	if e == nil {
-		return nil, 0
+	if c := m.takeChunk(); c != nil {
+		return c, m.chunks.Len()
 	}
-	c := m.chunks.Remove(e).(*MemoryChunk)
-	return c, m.chunks.Len()
+	if m.flushMode == FlushModeImmediate && len(m.staged) > 0 {
+		m.enqueueStaged()
+		if c := m.takeChunk(); c != nil {
+			return c, m.chunks.Len()
+		}
+	}
+	return nil, 0
+}
+
+// takeChunk is a part of popChunk. This function assumes called inside
+// locked block.
+func (m *Memory) takeChunk() *MemoryChunk {
+	for e := m.chunks.Back(); e != nil; e = e.Prev() {
+		c := e.Value.(*MemoryChunk)
+		if m.orderedFlush {
+			key := c.Metadata.Key()
+			if m.flushing[key] {
+				continue
+			}
+			m.flushing[key] = true
+		}
+		m.chunks.Remove(e)
+		// A room for a new chunk is made
+		m.local.broadcast()
+		return c
+	}
+	return nil
+}
+
+// release marks the chunk key as not being written.
+func (m *Memory) release(c *MemoryChunk) {
+	if !m.orderedFlush {
+		return
+	}
+	m.m.Lock()
+	delete(m.flushing, c.Metadata.Key())
+	m.m.Unlock()
+	m.notify()
 }
 
 func (m *Memory) flushChunks() {
+	m.m.Lock()
+	m.enqueueStaged()
+	m.m.Unlock()
 	for {
 		chunk, _ := m.popChunk()
 		if chunk == nil {
 			return
 		}
-		m.handler.Write(chunk.Items)
+		if _, err := m.writeChunk(chunk); err == nil {
+			m.store.Remove(chunk)
+		} else {
+			m.store.Close(chunk)
+		}
+		m.free(chunk.Size)
+		m.release(chunk)
 	}
 }
 
-func backOffTick(initial, max time.Duration) *backoff.Ticker {
+// closeChunks releases all remaining chunks without writing them. Staged
+// chunks are left staged.
+func (m *Memory) closeChunks() {
+	m.m.Lock()
+	for key, c := range m.staged {
+		m.store.Close(c)
+		m.free(c.Size)
+		delete(m.staged, key)
+	}
+	m.m.Unlock()
+	for {
+		chunk, _ := m.popChunk()
+		if chunk == nil {
+			return
+		}
+		m.store.Close(chunk)
+		m.free(chunk.Size)
+		m.release(chunk)
+	}
+}
+
+type bySeq []*MemoryChunk
+
+func (b bySeq) Len() int           { return len(b) }
+func (b bySeq) Less(i, j int) bool { return b[i].seq < b[j].seq }
+func (b bySeq) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func newBackOff(initial, max time.Duration) *backoff.ExponentialBackOff {
 	b := backoff.NewExponentialBackOff()
 	b.InitialInterval = initial
 	b.MaxInterval = max
 	b.MaxElapsedTime = 0 // infinite
-	return backoff.NewTicker(b)
+	b.Reset()
+	return b
 }
@@ -0,0 +1,642 @@
+package buffer
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type blockingHandler struct {
+	entered chan struct{}
+	release chan struct{}
+	dropped []Sizer
+	// Sizes of written chunks
+	sizes []int64
+	m     sync.Mutex
+}
+
+func (h *blockingHandler) Dropped(l []Sizer) {
+	h.dropped = append(h.dropped, l...)
+}
+
+func (h *blockingHandler) Write(l []Sizer) (int, error) {
+	select {
+	case h.entered <- struct{}{}:
+	default:
+	}
+	<-h.release
+	var size int64
+	for _, s := range l {
+		size += s.Size()
+	}
+	h.m.Lock()
+	h.sizes = append(h.sizes, size)
+	h.m.Unlock()
+	return len(l), nil
+}
+
+func fillQueue(t *testing.T, action OverflowAction) (*Memory, *blockingHandler, error) {
+	opts := &Options{
+		MaxChunkSize:   3,
+		MaxQueueSize:   2,
+		OverflowAction: action,
+		FlushInterval:  Duration(time.Hour),
+	}
+	opts.SetDefault()
+	h := &blockingHandler{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	m := NewMemory(opts, h, nil)
+
+	assert.NoError(t, m.Push(StringItem("aaa")))
+	assert.NoError(t, m.Push(StringItem("bbb")))
+	// The first chunk is being written, the second one is staged
+	<-h.entered
+	assert.NoError(t, m.Push(StringItem("ccc")))
+	return m, h, m.Push(StringItem("ddd"))
+}
+
+func TestUsage(t *testing.T) {
+	m, h, err := fillQueue(t, OverflowError)
+	assert.Equal(t, ErrQueueFull, err)
+	// Queued and staged chunks fill the queue
+	assert.Equal(t, 1.0, m.Usage())
+	close(h.release)
+	m.Close()
+	assert.Equal(t, 0.0, m.Usage())
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	m, h, err := fillQueue(t, OverflowDropOldest)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), m.Dropped())
+	assert.Equal(t, []Sizer{StringItem("bbb")}, h.dropped)
+	close(h.release)
+	m.Close()
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	m, h, err := fillQueue(t, OverflowDropNewest)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), m.Dropped())
+	assert.Equal(t, []Sizer{StringItem("ddd")}, h.dropped)
+	close(h.release)
+	m.Close()
+}
+
+func TestOverflowError(t *testing.T) {
+	m, h, err := fillQueue(t, OverflowError)
+	assert.Equal(t, ErrQueueFull, err)
+	assert.Equal(t, int64(1), m.Dropped())
+	close(h.release)
+	m.Close()
+}
+
+func TestOverflowBlock(t *testing.T) {
+	opts := &Options{
+		MaxChunkSize:   3,
+		MaxQueueSize:   1,
+		OverflowAction: OverflowBlock,
+		FlushInterval:  Duration(time.Hour),
+	}
+	opts.SetDefault()
+	h := &blockingHandler{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	m := NewMemory(opts, h, nil)
+	assert.NoError(t, m.Push(StringItem("aaa")))
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- m.Push(StringItem("bbb"))
+	}()
+	<-h.entered
+	assert.NoError(t, <-pushed)
+	close(h.release)
+	m.Close()
+	assert.Equal(t, int64(0), m.Dropped())
+}
+
+func (m *Memory) waitBlocked(n int) {
+	for {
+		m.m.Lock()
+		blocked := m.blocked
+		m.m.Unlock()
+		if blocked >= n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestOverflowBlockChunkSize(t *testing.T) {
+	opts := &Options{
+		MaxChunkSize:   3,
+		TotalLimitSize: 10,
+		OverflowAction: OverflowBlock,
+		FlushInterval:  Duration(time.Hour),
+	}
+	opts.SetDefault()
+	h := &blockingHandler{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	m := NewMemory(opts, h, nil)
+	for _, s := range []string{"aaa", "aaa", "aaa", "b"} {
+		assert.NoError(t, m.Push(StringItem(s)))
+	}
+
+	// Both pushes fit in the staged chunk of "b" before waiting, but only
+	// one of them does after that
+	pushed := make(chan error)
+	for _, s := range []string{"cc", "dd"} {
+		go func(s string) {
+			pushed <- m.Push(StringItem(s))
+		}(s)
+	}
+	m.waitBlocked(2)
+	h.release <- struct{}{}
+	h.release <- struct{}{}
+	assert.NoError(t, <-pushed)
+	assert.NoError(t, <-pushed)
+	close(h.release)
+	m.Close()
+
+	var total int64
+	for _, size := range h.sizes {
+		assert.True(t, size <= 3, "chunk of %d bytes", size)
+		total += size
+	}
+	assert.Equal(t, int64(14), total)
+}
+
+func TestOverflowBlockInterrupt(t *testing.T) {
+	opts := &Options{
+		MaxChunkSize:   3,
+		MaxQueueSize:   1,
+		OverflowAction: OverflowBlock,
+		FlushInterval:  Duration(time.Hour),
+	}
+	opts.SetDefault()
+	h := &blockingHandler{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	m := NewMemory(opts, h, nil)
+	assert.NoError(t, m.Push(StringItem("aaa")))
+	assert.NoError(t, m.Push(StringItem("bbb")))
+	<-h.entered
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- m.Push(StringItem("ccc"))
+	}()
+	m.waitBlocked(1)
+	m.Interrupt()
+	assert.Equal(t, ErrInterrupted, <-pushed)
+	// No longer blocks
+	assert.Equal(t, ErrInterrupted, m.Push(StringItem("ddd")))
+	assert.Equal(t, int64(2), m.Dropped())
+	close(h.release)
+	m.Close()
+}
+
+type discardHandler struct {
+	attempts  int
+	discarded chan []Sizer
+}
+
+func (h *discardHandler) Write(l []Sizer) (int, error) {
+	h.attempts++
+	return 0, errors.New("unavailable")
+}
+
+func (h *discardHandler) Discard(l []Sizer) int {
+	h.discarded <- l
+	return 0
+}
+
+func TestRetryLimit(t *testing.T) {
+	opts := &Options{
+		RetryLimit:    2,
+		RetryInterval: Duration(time.Millisecond),
+	}
+	opts.SetDefault()
+	h := &discardHandler{discarded: make(chan []Sizer, 1)}
+	m := NewMemory(opts, h, nil)
+	assert.NoError(t, m.Push(StringItem("foo")))
+
+	assert.Equal(t, []Sizer{StringItem("foo")}, <-h.discarded)
+	m.Close()
+	assert.Equal(t, 3, h.attempts)
+	assert.Equal(t, int64(0), m.Dropped())
+	stats := m.Stats()
+	assert.Equal(t, int64(2), stats.Retries)
+	assert.Nil(t, stats.NextRetry)
+	assert.Equal(t, int64(3), stats.FlushLatency.Counts[0])
+}
+
+// shutdownHandler fails chunks of "bad", and blocks writing others until
+// released.
+type shutdownHandler struct {
+	failed  chan struct{}
+	entered chan struct{}
+	release chan struct{}
+	written []string
+	m       sync.Mutex
+}
+
+func (h *shutdownHandler) Write(l []Sizer) (int, error) {
+	return h.WriteWithMetadata(nil, l)
+}
+
+func (h *shutdownHandler) WriteWithMetadata(meta *Metadata, l []Sizer) (int, error) {
+	if meta.Tag == "bad" {
+		select {
+		case h.failed <- struct{}{}:
+		default:
+		}
+		return 0, errors.New("unavailable")
+	}
+	select {
+	case h.entered <- struct{}{}:
+	default:
+	}
+	<-h.release
+	h.m.Lock()
+	defer h.m.Unlock()
+	for _, s := range l {
+		h.written = append(h.written, string(s.(StringItem)))
+	}
+	return len(l), nil
+}
+
+func TestCloseWhileRetrying(t *testing.T) {
+	opts := &Options{
+		MaxChunkSize:     1,
+		ChunkKeys:        []string{"tag"},
+		FlushMode:        FlushModeLazy,
+		FlushThreadCount: 2,
+		RetryInterval:    Duration(time.Hour),
+	}
+	opts.SetDefault()
+	h := &shutdownHandler{
+		failed:  make(chan struct{}, 1),
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	m := NewMemory(opts, h, nil)
+	push := func(tag string) {
+		assert.NoError(t, m.PushWithMetadata(opts.Metadata(tag, time.Now(), nil), StringItem("x")))
+	}
+	// One thread is retrying, and the other one is writing
+	push("bad")
+	push("bad")
+	<-h.failed
+	push("good")
+	push("good")
+	<-h.entered
+	push("good")
+
+	// The thread retrying doesn't discard the chunks flushed at shutdown
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	close(h.release)
+	<-closed
+	assert.Equal(t, []string{"x", "x", "x"}, h.written)
+	assert.Equal(t, int64(0), m.Stats().TotalSize)
+}
+
+type metadataHandler struct {
+	chunks map[string][]Sizer
+	m      sync.Mutex
+}
+
+func (h *metadataHandler) Write(l []Sizer) (int, error) {
+	return h.WriteWithMetadata(nil, l)
+}
+
+func (h *metadataHandler) WriteWithMetadata(meta *Metadata, l []Sizer) (int, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	key := meta.Tag + "@" + meta.Timekey.Format("15:04")
+	h.chunks[key] = append(h.chunks[key], l...)
+	return len(l), nil
+}
+
+func TestChunkKeys(t *testing.T) {
+	opts := &Options{
+		ChunkKeys:     []string{"tag", "time"},
+		FlushInterval: Duration(time.Hour),
+	}
+	opts.SetDefault()
+	h := &metadataHandler{chunks: make(map[string][]Sizer)}
+	m := NewMemory(opts, h, nil)
+
+	t1 := time.Date(2015, 1, 1, 10, 30, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	assert.NoError(t, m.PushWithMetadata(opts.Metadata("foo", t1, nil), StringItem("1")))
+	assert.NoError(t, m.PushWithMetadata(opts.Metadata("bar", t1, nil), StringItem("2")))
+	assert.NoError(t, m.PushWithMetadata(opts.Metadata("foo", t2, nil), StringItem("3")))
+	assert.NoError(t, m.PushWithMetadata(opts.Metadata("foo", t1, nil), StringItem("4")))
+	m.Close()
+
+	assert.Equal(t, map[string][]Sizer{
+		"foo@10:00": {StringItem("1"), StringItem("4")},
+		"bar@10:00": {StringItem("2")},
+		"foo@11:00": {StringItem("3")},
+	}, h.chunks)
+}
+
+type concurrencyHandler struct {
+	running map[string]int
+	max     map[string]int
+	done    chan struct{}
+	m       sync.Mutex
+}
+
+func (h *concurrencyHandler) Write(l []Sizer) (int, error) {
+	return h.WriteWithMetadata(nil, l)
+}
+
+func (h *concurrencyHandler) WriteWithMetadata(meta *Metadata, l []Sizer) (int, error) {
+	h.m.Lock()
+	h.running[meta.Tag]++
+	if h.running[meta.Tag] > h.max[meta.Tag] {
+		h.max[meta.Tag] = h.running[meta.Tag]
+	}
+	h.m.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	h.m.Lock()
+	h.running[meta.Tag]--
+	h.m.Unlock()
+	h.done <- struct{}{}
+	return len(l), nil
+}
+
+func TestFlushThreads(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		opts := &Options{
+			MaxChunkSize:     1,
+			ChunkKeys:        []string{"tag"},
+			FlushInterval:    Duration(time.Hour),
+			FlushThreadCount: 4,
+			OrderedFlush:     ordered,
+		}
+		opts.SetDefault()
+		h := &concurrencyHandler{
+			running: make(map[string]int),
+			max:     make(map[string]int),
+			done:    make(chan struct{}, 5),
+		}
+		m := NewMemory(opts, h, nil)
+		for _, tag := range []string{"foo", "foo", "foo", "bar", "bar"} {
+			assert.NoError(t, m.PushWithMetadata(opts.Metadata(tag, time.Now(), nil), StringItem("x")))
+		}
+		// Chunks enqueued by the pushes are written before closing
+		for i := 0; i < 3; i++ {
+			<-h.done
+		}
+		m.Close()
+
+		if ordered {
+			assert.Equal(t, map[string]int{"foo": 1, "bar": 1}, h.max)
+		} else {
+			assert.True(t, h.max["foo"] > 1 || h.max["bar"] > 1)
+		}
+	}
+}
+
+func TestTotalLimitSize(t *testing.T) {
+	opts := &Options{
+		MaxChunkSize:   3,
+		MaxQueueSize:   100,
+		TotalLimitSize: 6,
+		OverflowAction: OverflowError,
+		FlushInterval:  Duration(time.Hour),
+	}
+	opts.SetDefault()
+	h := &blockingHandler{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	m := NewMemory(opts, h, nil)
+
+	assert.NoError(t, m.Push(StringItem("aaa")))
+	assert.NoError(t, m.Push(StringItem("bb")))
+	<-h.entered
+	// Chunks being written still count
+	assert.NoError(t, m.Push(StringItem("c")))
+	assert.Equal(t, ErrQueueFull, m.Push(StringItem("d")))
+	assert.Equal(t, int64(6), m.Stats().TotalSize)
+	assert.Equal(t, 1.0, m.Usage())
+
+	close(h.release)
+	m.Close()
+	assert.Equal(t, int64(0), m.Stats().TotalSize)
+	assert.Equal(t, int64(1), m.Stats().Dropped)
+}
+
+func TestGlobalLimitSize(t *testing.T) {
+	defer globalLimiter.setLimit(0)
+
+	opts := &Options{
+		MaxChunkSize:    3,
+		OverflowAction:  OverflowDropNewest,
+		FlushInterval:   Duration(time.Hour),
+		GlobalLimitSize: 4,
+	}
+	opts.SetDefault()
+	h := &blockingHandler{
+		entered: make(chan struct{}, 2),
+		release: make(chan struct{}),
+	}
+	m1 := NewMemory(opts, h, nil)
+	m2 := NewMemory(opts, h, nil)
+
+	assert.NoError(t, m1.Push(StringItem("aaa")))
+	assert.NoError(t, m2.Push(StringItem("b")))
+	assert.NoError(t, m2.Push(StringItem("c")))
+	assert.Equal(t, int64(0), m1.Dropped())
+	assert.Equal(t, int64(1), m2.Dropped())
+
+	close(h.release)
+	m1.Close()
+	m2.Close()
+}
+
+func TestOverflowBlockRelease(t *testing.T) {
+	defer globalLimiter.setLimit(0)
+
+	opts := &Options{
+		MaxChunkSize:    1,
+		OverflowAction:  OverflowBlock,
+		FlushMode:       FlushModeImmediate,
+		GlobalLimitSize: 2,
+	}
+	opts.SetDefault()
+	h := &testHandler{}
+	buffers := make([]*Memory, 4)
+	for i := range buffers {
+		buffers[i] = NewMemory(opts, h, nil)
+	}
+
+	// Pushes block on the global limit, while flushes of other buffers free
+	// the room concurrently
+	const n = 2000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, m := range buffers {
+		wg.Add(1)
+		go func(m *Memory) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				assert.NoError(t, m.Push(StringItem("a")))
+			}
+		}(m)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Pushes are blocked while the room is free")
+	}
+	for _, m := range buffers {
+		m.Close()
+	}
+	assert.Len(t, h.items, len(buffers)*n)
+}
+
+type compressedHandler struct {
+	testHandler
+	chunks []*CompressedItem
+}
+
+func (h *compressedHandler) AcceptCompressed(format Compression) bool {
+	return format == CompressGzip
+}
+
+func (h *compressedHandler) WriteCompressed(meta *Metadata, c *CompressedItem) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.chunks = append(h.chunks, c)
+	return h.err
+}
+
+func TestCompress(t *testing.T) {
+	item := BytesItem(strings.Repeat(`{"message":"hello"}`, 10))
+	for _, format := range []Compression{CompressGzip, CompressZstd} {
+		opts := &Options{
+			MaxChunkSize:  500,
+			FlushInterval: Duration(time.Hour),
+			Compress:      format,
+		}
+		opts.SetDefault()
+		h := &compressedHandler{}
+		m := NewMemory(opts, h, nil)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, m.Push(item))
+		}
+		m.Close()
+
+		if format == CompressGzip {
+			assert.Len(t, h.chunks, 2)
+			assert.Len(t, h.items, 0)
+			for _, c := range h.chunks {
+				assert.True(t, c.Size() < int64(c.Len())*item.Size())
+				items, err := c.Items()
+				assert.NoError(t, err)
+				for _, i := range items {
+					assert.Equal(t, item, i)
+				}
+			}
+		} else {
+			assert.Len(t, h.chunks, 0)
+			assert.Equal(t, []Sizer{item, item, item}, h.items)
+		}
+		assert.Equal(t, int64(0), m.Stats().TotalSize)
+	}
+}
+
+func (h *testHandler) written() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return len(h.items)
+}
+
+// timingHandler sends the time when each chunk is written.
+type timingHandler struct {
+	written chan time.Time
+}
+
+func (h *timingHandler) Write(l []Sizer) (int, error) {
+	h.written <- time.Now()
+	return len(l), nil
+}
+
+// testTimekeyFlush pushes an item in the current time slice, and checks that
+// it is written after the slice is closed and the timekey wait is elapsed.
+func testTimekeyFlush(t *testing.T, mode FlushMode) {
+	opts := &Options{
+		FlushMode:   mode,
+		ChunkKeys:   []string{"time"},
+		Timekey:     Duration(200 * time.Millisecond),
+		TimekeyWait: Duration(200 * time.Millisecond),
+	}
+	opts.SetDefault()
+	h := &timingHandler{written: make(chan time.Time, 1)}
+	m := NewMemory(opts, h, nil)
+	defer m.Close()
+
+	meta := opts.Metadata("foo", time.Now(), nil)
+	assert.NoError(t, m.PushWithMetadata(meta, StringItem("foo")))
+	select {
+	case at := <-h.written:
+		assert.False(t, at.Before(meta.Timekey.Add(400*time.Millisecond)))
+	case <-time.After(time.Second):
+		t.Fatal("the chunk is not flushed after the timekey")
+	}
+}
+
+func TestFlushModeAligned(t *testing.T) {
+	testTimekeyFlush(t, FlushModeAligned)
+}
+
+func TestFlushModeLazy(t *testing.T) {
+	testTimekeyFlush(t, FlushModeLazy)
+}
+
+func TestFlushAtShutdown(t *testing.T) {
+	for _, flush := range []bool{true, false} {
+		opts := &Options{
+			FlushMode:       FlushModeLazy,
+			FlushAtShutdown: &flush,
+		}
+		opts.SetDefault()
+		h := &testHandler{}
+		m := NewMemory(opts, h, nil)
+		assert.NoError(t, m.Push(StringItem("foo")))
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 0, h.written())
+		m.Close()
+
+		if flush {
+			assert.Equal(t, 1, h.written())
+		} else {
+			assert.Equal(t, 0, h.written())
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package buffer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	itemCompressed        = 'z'
+	itemCompressedWrapped = 'w'
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+
+	errBrokenCompressedItem = errors.New("Broken compressed item")
+)
+
+// Wrapper is implemented by items which carry another item along with state
+// such as acknowledgements. The inner item is compressed, and the wrapper is
+// kept without it, then Wrap restores the item after decompression.
+type Wrapper interface {
+	Unwrap() Sizer
+	Wrap(Sizer) Sizer
+}
+
+// CompressedItem holds all items of a chunk as a single compressed block.
+// Data is the concatenation of the items compressed in Format, so that
+// outputs can send it as is.
+type CompressedItem struct {
+	Format Compression
+	Data   []byte
+	Sizes  []int64
+	// Wrappers of the items without the inner items, nil for items not
+	// wrapped. Nil if no item is wrapped.
+	Wrappers []Sizer
+}
+
+func (c *CompressedItem) Size() int64 {
+	return int64(len(c.Data))
+}
+
+// Len returns the number of items in the block.
+func (c *CompressedItem) Len() int {
+	return len(c.Sizes)
+}
+
+// Items decompresses the block into the original items.
+func (c *CompressedItem) Items() ([]Sizer, error) {
+	b, err := decompress(c.Format, c.Data)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Sizer, len(c.Sizes))
+	for i, n := range c.Sizes {
+		if n > int64(len(b)) {
+			return nil, errBrokenCompressedItem
+		}
+		items[i] = BytesItem(b[:n:n])
+		if c.Wrappers != nil && c.Wrappers[i] != nil {
+			items[i] = c.Wrappers[i].(Wrapper).Wrap(items[i])
+		}
+		b = b[n:]
+	}
+	return items, nil
+}
+
+func (c *CompressedItem) ItemType() byte {
+	if c.Wrappers != nil {
+		return itemCompressedWrapped
+	}
+	return itemCompressed
+}
+
+// MarshalBinary encodes the item as a format byte, the number of items, the
+// size of each item and the compressed data. Wrappers are encoded as records
+// before the data, an empty record for items not wrapped.
+func (c *CompressedItem) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 1+binary.MaxVarintLen64*(len(c.Sizes)+1), 1+binary.MaxVarintLen64*(len(c.Sizes)+1)+len(c.Data))
+	b[0] = byte(c.Format)
+	n := 1 + binary.PutUvarint(b[1:], uint64(len(c.Sizes)))
+	for _, size := range c.Sizes {
+		n += binary.PutUvarint(b[n:], uint64(size))
+	}
+	b = b[:n]
+	for _, w := range c.Wrappers {
+		if w == nil {
+			b = append(b, encodeRecord(0, nil)...)
+			continue
+		}
+		rec, err := encodeItem(w)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, rec...)
+	}
+	return append(b, c.Data...), nil
+}
+
+func decodeCompressedItem(b []byte) (Sizer, error) {
+	c, b, err := decodeCompressedHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c.Data = b
+	return c, nil
+}
+
+func decodeCompressedWrappedItem(b []byte) (Sizer, error) {
+	c, b, err := decodeCompressedHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c.Wrappers = make([]Sizer, len(c.Sizes))
+	for i := range c.Wrappers {
+		if len(b) == 0 {
+			return nil, errBrokenCompressedItem
+		}
+		typ := b[0]
+		size, n := binary.Uvarint(b[1:])
+		if n <= 0 || size > uint64(len(b)-1-n) {
+			return nil, errBrokenCompressedItem
+		}
+		data := b[1+n : 1+n+int(size)]
+		b = b[1+n+int(size):]
+		if typ == 0 {
+			continue
+		}
+		dec, ok := itemDecoders[typ]
+		if !ok {
+			return nil, fmt.Errorf("Unknown item type in compressed item: %c", typ)
+		}
+		if c.Wrappers[i], err = dec(data); err != nil {
+			return nil, err
+		}
+	}
+	c.Data = b
+	return c, nil
+}
+
+func init() {
+	// Registered here since the decoder looks up the decoders of wrappers
+	RegisterItem(itemCompressedWrapped, decodeCompressedWrappedItem)
+}
+
+// decodeCompressedHeader decodes the format and the sizes of the items, and
+// returns the rest of b.
+func decodeCompressedHeader(b []byte) (*CompressedItem, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errBrokenCompressedItem
+	}
+	c := &CompressedItem{Format: Compression(b[0])}
+	b = b[1:]
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)) {
+		return nil, nil, errBrokenCompressedItem
+	}
+	b = b[n:]
+	c.Sizes = make([]int64, count)
+	for i := range c.Sizes {
+		size, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errBrokenCompressedItem
+		}
+		c.Sizes[i] = int64(size)
+		b = b[n:]
+	}
+	return c, b, nil
+}
+
+// compressItems compresses the items in the format. It returns nil if any
+// item is not BytesItem, or a Wrapper of BytesItem, since other items can't
+// be restored from bytes.
+func compressItems(format Compression, items []Sizer) (*CompressedItem, error) {
+	var size int64
+	var wrappers []Sizer
+	sizes := make([]int64, len(items))
+	inner := make([]BytesItem, len(items))
+	for i, item := range items {
+		if w, ok := item.(Wrapper); ok {
+			if wrappers == nil {
+				wrappers = make([]Sizer, len(items))
+			}
+			wrappers[i] = w.Wrap(BytesItem(nil))
+			item = w.Unwrap()
+		}
+		b, ok := item.(BytesItem)
+		if !ok {
+			return nil, nil
+		}
+		inner[i] = b
+		sizes[i] = int64(len(b))
+		size += sizes[i]
+	}
+
+	raw := make([]byte, 0, size)
+	for _, b := range inner {
+		raw = append(raw, b...)
+	}
+	data, err := compress(format, raw)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedItem{Format: format, Data: data, Sizes: sizes, Wrappers: wrappers}, nil
+}
+
+func compress(format Compression, b []byte) ([]byte, error) {
+	switch format {
+	case CompressGzip:
+		buf := new(bytes.Buffer)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressZstd:
+		return zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("Unknown compression format: %d", format)
+}
+
+func decompress(format Compression, b []byte) ([]byte, error) {
+	switch format {
+	case CompressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CompressZstd:
+		return zstdDecoder.DecodeAll(b, nil)
+	}
+	return nil, fmt.Errorf("Unknown compression format: %d", format)
+}
@@ -1,6 +1,7 @@
 package buffer
 
 import (
+	"errors"
 	"strconv"
 	"time"
 )
@@ -54,14 +55,119 @@ func (d *Duration) UnmarshalText(b []byte) error {
 	return nil
 }
 
+type OverflowAction int
+
+const (
+	OverflowDropOldest OverflowAction = iota
+	OverflowDropNewest
+	OverflowBlock
+	OverflowError
+)
+
+func (a *OverflowAction) UnmarshalText(b []byte) (err error) {
+	switch string(b) {
+	case "", "drop_oldest":
+		*a = OverflowDropOldest
+	case "drop_newest":
+		*a = OverflowDropNewest
+	case "block":
+		*a = OverflowBlock
+	case "error":
+		*a = OverflowError
+	default:
+		err = errors.New("overflow_action must be drop_oldest, drop_newest, block or error")
+	}
+	return
+}
+
+type FlushMode int
+
+const (
+	FlushModeDefault FlushMode = iota
+	FlushModeInterval
+	FlushModeImmediate
+	FlushModeLazy
+	FlushModeAligned
+)
+
+func (f *FlushMode) UnmarshalText(b []byte) (err error) {
+	switch string(b) {
+	case "":
+		*f = FlushModeDefault
+	case "interval":
+		*f = FlushModeInterval
+	case "immediate":
+		*f = FlushModeImmediate
+	case "lazy":
+		*f = FlushModeLazy
+	case "aligned":
+		*f = FlushModeAligned
+	default:
+		err = errors.New("flush_mode must be interval, immediate, lazy or aligned")
+	}
+	return
+}
+
+type Compression int
+
+const (
+	CompressNone Compression = iota
+	CompressGzip
+	CompressZstd
+)
+
+func (c *Compression) UnmarshalText(b []byte) (err error) {
+	switch string(b) {
+	case "", "none":
+		*c = CompressNone
+	case "gzip":
+		*c = CompressGzip
+	case "zstd":
+		*c = CompressZstd
+	default:
+		err = errors.New("compress must be none, gzip or zstd")
+	}
+	return
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressGzip:
+		return "gzip"
+	case CompressZstd:
+		return "zstd"
+	}
+	return "none"
+}
+
 type Options struct {
-	Name             string    `toml:"name" codec:"name"`
-	Type             string    `toml:"type" codec:"type"`
-	MaxChunkSize     HumanSize `toml:"max_chunk_size" codec:"max_chunk_size"`
-	MaxQueueSize     HumanSize `toml:"max_queue_size" codec:"max_queue_size"`
-	FlushInterval    Duration  `toml:"flush_interval" codec:"flush_interval"`
-	RetryInterval    Duration  `toml:"retry_interval" codec:"retry_interval"`
-	MaxRetryInterval Duration  `toml:"max_retry_interval" codec:"max_retry_interval"`
+	Name             string         `toml:"name" codec:"name"`
+	Type             string         `toml:"type" codec:"type"`
+	Path             string         `toml:"path" codec:"path"`
+	MaxChunkSize     HumanSize      `toml:"max_chunk_size" codec:"max_chunk_size"`
+	MaxQueueSize     HumanSize      `toml:"max_queue_size" codec:"max_queue_size"`
+	OverflowAction   OverflowAction `toml:"overflow_action" codec:"overflow_action"`
+	FlushMode        FlushMode      `toml:"flush_mode" codec:"flush_mode"`
+	FlushInterval    Duration       `toml:"flush_interval" codec:"flush_interval"`
+	FlushAtShutdown  *bool          `toml:"flush_at_shutdown" codec:"flush_at_shutdown"`
+	RetryInterval    Duration       `toml:"retry_interval" codec:"retry_interval"`
+	MaxRetryInterval Duration       `toml:"max_retry_interval" codec:"max_retry_interval"`
+	RetryLimit       int            `toml:"retry_limit" codec:"retry_limit"`
+	RetryTimeout     Duration       `toml:"retry_timeout" codec:"retry_timeout"`
+	ChunkKeys        []string       `toml:"chunk_keys" codec:"chunk_keys"`
+	Timekey          Duration       `toml:"timekey" codec:"timekey"`
+	TimekeyWait      Duration       `toml:"timekey_wait" codec:"timekey_wait"`
+	FlushThreadCount int            `toml:"flush_thread_count" codec:"flush_thread_count"`
+	OrderedFlush     bool           `toml:"ordered_flush" codec:"ordered_flush"`
+	TotalLimitSize   HumanSize      `toml:"total_limit_size" codec:"total_limit_size"`
+	Compress         Compression    `toml:"compress" codec:"compress"`
+	// Inputs are paused when the usage exceeds the high watermark, until it
+	// falls below the low watermark
+	HighWatermark float64 `toml:"high_watermark" codec:"high_watermark"`
+	LowWatermark  float64 `toml:"low_watermark" codec:"low_watermark"`
+
+	// Limits the size of all buffers in the process, set by the engine
+	GlobalLimitSize HumanSize `toml:"-" codec:"global_limit_size"`
 }
 
 func (o *Options) SetDefault() {
@@ -80,10 +186,39 @@ func (o *Options) SetDefault() {
 	if o.FlushInterval == 0 {
 		o.FlushInterval = Duration(0)
 	}
+	o.FlushMode = o.flushMode()
+	if o.FlushAtShutdown == nil {
+		flush := true
+		o.FlushAtShutdown = &flush
+	}
 	if o.RetryInterval == 0 {
 		o.RetryInterval = Duration(100 * time.Millisecond)
 	}
 	if o.MaxRetryInterval == 0 {
 		o.MaxRetryInterval = Duration(time.Minute)
 	}
+	if o.FlushThreadCount == 0 {
+		o.FlushThreadCount = 1
+	}
+	if o.Timekey == 0 {
+		o.Timekey = Duration(time.Hour)
+	}
+	if o.HighWatermark == 0 {
+		o.HighWatermark = 0.8
+	}
+	if o.LowWatermark == 0 || o.LowWatermark >= o.HighWatermark {
+		o.LowWatermark = o.HighWatermark / 2
+	}
+}
+
+// flushMode returns the flush mode. Unless specified, chunks are flushed
+// immediately without the flush interval.
+func (o *Options) flushMode() FlushMode {
+	if o.FlushMode != FlushModeDefault {
+		return o.FlushMode
+	}
+	if o.FlushInterval == 0 {
+		return FlushModeImmediate
+	}
+	return FlushModeInterval
 }
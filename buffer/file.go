@@ -0,0 +1,391 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	stateStaged = 'b'
+	stateQueued = 'q'
+
+	itemBytes    = 'b'
+	itemString   = 's'
+	itemMetadata = 'm'
+
+	// Used to detect broken length field
+	maxItemSize = 1 << 31
+)
+
+// BinaryItem is implemented by items other than BytesItem and StringItem to
+// be stored in file buffers. The type must be registered by RegisterItem.
+type BinaryItem interface {
+	Sizer
+	ItemType() byte
+	MarshalBinary() ([]byte, error)
+}
+
+// ItemDecoder restores an item from the bytes made by its MarshalBinary.
+type ItemDecoder func([]byte) (Sizer, error)
+
+var itemDecoders = map[byte]ItemDecoder{
+	itemBytes: func(b []byte) (Sizer, error) {
+		return BytesItem(b), nil
+	},
+	itemString: func(b []byte) (Sizer, error) {
+		return StringItem(b), nil
+	},
+	itemCompressed: decodeCompressedItem,
+}
+
+// RegisterItem registers the decoder for items of the type. It's intended to
+// be called from init functions.
+func RegisterItem(typ byte, dec ItemDecoder) {
+	if _, ok := itemDecoders[typ]; ok {
+		panic(fmt.Sprintf("buffer: item type %c registered twice", typ))
+	}
+	itemDecoders[typ] = dec
+}
+
+// File is a buffer which persists every chunk into a file under the
+// configured path, so that buffered items survive process restarts.
+type File struct {
+	*Memory
+}
+
+func NewFile(opts *Options, h Handler, l Logger) (*File, error) {
+	if opts.Path == "" {
+		return nil, errors.New("File buffer requires path")
+	}
+	if err := os.MkdirAll(opts.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	store := &fileStore{
+		dir:   opts.Path,
+		files: make(map[*MemoryChunk]*chunkFile),
+	}
+	m := newMemory(opts, h, l, store)
+	if err := store.restore(m); err != nil {
+		return nil, err
+	}
+	queued := m.chunks.Len() > 0
+	m.start()
+	if queued {
+		m.notify()
+	}
+	return &File{m}, nil
+}
+
+type chunkFile struct {
+	id    uint64
+	state byte
+	f     *os.File
+}
+
+type fileStore struct {
+	dir   string
+	seq   uint64
+	files map[*MemoryChunk]*chunkFile
+	m     sync.Mutex
+}
+
+func (s *fileStore) path(id uint64, state byte) string {
+	return filepath.Join(s.dir, fmt.Sprintf("buffer.%c%016x.log", state, id))
+}
+
+// restore loads chunk files left by the previous run. The last staged chunk
+// continues to be staged, all others are queued in creation order.
+func (s *fileStore) restore(m *Memory) error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "buffer.*.log"))
+	if err != nil {
+		return err
+	}
+
+	var cfs []*chunkFile
+	for _, name := range names {
+		base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "buffer."), ".log")
+		if len(base) < 2 || (base[0] != stateStaged && base[0] != stateQueued) {
+			continue
+		}
+		id, err := strconv.ParseUint(base[1:], 16, 64)
+		if err != nil {
+			continue
+		}
+		cfs = append(cfs, &chunkFile{id: id, state: base[0]})
+		if id >= s.seq {
+			s.seq = id + 1
+		}
+	}
+	sort.Sort(byID(cfs))
+
+	var chunks []*MemoryChunk
+	last := make(map[string]*MemoryChunk)
+	for _, cf := range cfs {
+		c, err := s.load(cf)
+		if err != nil {
+			return err
+		}
+		if len(c.Items) == 0 {
+			os.Remove(s.path(cf.id, cf.state))
+			continue
+		}
+		s.files[c] = cf
+		chunks = append(chunks, c)
+		if cf.state == stateStaged {
+			last[c.Metadata.Key()] = c
+		}
+	}
+
+	for _, c := range chunks {
+		c.seq = m.seq
+		m.seq++
+		m.local.acquire(c.Size)
+		m.global.acquire(c.Size)
+		if key := c.Metadata.Key(); last[key] == c {
+			cf := s.files[c]
+			if cf.f, err = os.OpenFile(s.path(cf.id, cf.state), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				return err
+			}
+			m.staged[key] = c
+			continue
+		}
+		if err = s.Enqueue(c); err != nil {
+			return err
+		}
+		m.chunks.PushFront(c)
+	}
+	return nil
+}
+
+func (s *fileStore) load(cf *chunkFile) (*MemoryChunk, error) {
+	f, err := os.Open(s.path(cf.id, cf.state))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &MemoryChunk{}
+	r := bufio.NewReader(f)
+	for {
+		typ, b, err := readRecord(r)
+		if err == io.EOF {
+			return c, nil
+		}
+		if err == nil {
+			err = c.restore(typ, b)
+		}
+		if err != nil {
+			// The last item may be partially written, drop the rest
+			break
+		}
+	}
+	return c, writeItems(s.path(cf.id, cf.state), c.Metadata, c.Items)
+}
+
+func (s *fileStore) Create(c *MemoryChunk) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	cf := &chunkFile{id: s.seq, state: stateStaged}
+	f, err := os.OpenFile(s.path(cf.id, cf.state), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	cf.f = f
+	s.files[c] = cf
+	if c.Metadata != nil {
+		b, err := encodeMetadata(c.Metadata)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(b)
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) Append(c *MemoryChunk, item Sizer) error {
+	cf := s.get(c)
+	b, err := encodeItem(item)
+	if err != nil {
+		return err
+	}
+	_, err = cf.f.Write(b)
+	return err
+}
+
+func (s *fileStore) Enqueue(c *MemoryChunk) error {
+	cf := s.get(c)
+	if cf.state == stateQueued {
+		return nil
+	}
+	if cf.f != nil {
+		cf.f.Sync()
+		cf.f.Close()
+		cf.f = nil
+	}
+	if err := os.Rename(s.path(cf.id, cf.state), s.path(cf.id, stateQueued)); err != nil {
+		return err
+	}
+	cf.state = stateQueued
+	return nil
+}
+
+func (s *fileStore) Update(c *MemoryChunk) error {
+	cf := s.get(c)
+	return writeItems(s.path(cf.id, cf.state), c.Metadata, c.Items)
+}
+
+func (s *fileStore) Remove(c *MemoryChunk) error {
+	cf := s.release(c)
+	return os.Remove(s.path(cf.id, cf.state))
+}
+
+func (s *fileStore) Close(c *MemoryChunk) error {
+	if cf := s.release(c); cf.f != nil {
+		cf.f.Sync()
+		return cf.f.Close()
+	}
+	return nil
+}
+
+func (s *fileStore) get(c *MemoryChunk) *chunkFile {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.files[c]
+}
+
+func (s *fileStore) release(c *MemoryChunk) *chunkFile {
+	s.m.Lock()
+	defer s.m.Unlock()
+	cf := s.files[c]
+	delete(s.files, c)
+	if cf.f != nil {
+		cf.f.Close()
+		cf.f = nil
+	}
+	return cf
+}
+
+type byID []*chunkFile
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Less(i, j int) bool { return b[i].id < b[j].id }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// encodeItem serializes an item as a record.
+func encodeItem(item Sizer) ([]byte, error) {
+	var typ byte
+	var data []byte
+	switch v := item.(type) {
+	case BytesItem:
+		typ, data = itemBytes, v
+	case StringItem:
+		typ, data = itemString, []byte(v)
+	case BinaryItem:
+		var err error
+		if data, err = v.MarshalBinary(); err != nil {
+			return nil, err
+		}
+		typ = v.ItemType()
+	default:
+		return nil, fmt.Errorf("File buffer does not support item type: %T", item)
+	}
+	return encodeRecord(typ, data), nil
+}
+
+func encodeMetadata(meta *Metadata) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return encodeRecord(itemMetadata, data), nil
+}
+
+// encodeRecord serializes data as a type byte, a varint length and the data.
+func encodeRecord(typ byte, data []byte) []byte {
+	b := make([]byte, 1+binary.MaxVarintLen64+len(data))
+	b[0] = typ
+	n := 1 + binary.PutUvarint(b[1:], uint64(len(data)))
+	n += copy(b[n:], data)
+	return b[:n]
+}
+
+func readRecord(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > maxItemSize {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return typ, b, nil
+}
+
+// restore restores a record read from the chunk file.
+func (m *MemoryChunk) restore(typ byte, b []byte) error {
+	if typ == itemMetadata {
+		m.Metadata = &Metadata{}
+		return json.Unmarshal(b, m.Metadata)
+	}
+	dec, ok := itemDecoders[typ]
+	if !ok {
+		return fmt.Errorf("Unknown item type in buffer file: %c", typ)
+	}
+	item, err := dec(b)
+	if err != nil {
+		return err
+	}
+	m.Push(item)
+	return nil
+}
+
+// writeItems atomically replaces the file with the metadata and items.
+func writeItems(path string, meta *Metadata, items []Sizer) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if meta != nil {
+		b, err := encodeMetadata(meta)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(b)
+	}
+	for _, item := range items {
+		b, err := encodeItem(item)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(b)
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,154 @@
+package buffer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandler struct {
+	items []Sizer
+	err   error
+	m     sync.Mutex
+}
+
+func (h *testHandler) Write(l []Sizer) (int, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.err != nil {
+		return 0, h.err
+	}
+	h.items = append(h.items, l...)
+	return len(l), nil
+}
+
+func TestFileRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluxion-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &Options{Type: "file", Path: dir, MaxChunkSize: 8, FlushInterval: Duration(time.Hour)}
+	opts.SetDefault()
+
+	h := &testHandler{err: errors.New("unavailable")}
+	buf, err := NewFile(opts, h, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, buf.Push(BytesItem("foo")))
+	assert.NoError(t, buf.Push(StringItem("bar")))
+	assert.NoError(t, buf.Push(BytesItem("bazqux")))
+	buf.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "buffer.*.log"))
+	assert.Len(t, files, 2)
+
+	h = &testHandler{}
+	buf, err = NewFile(opts, h, nil)
+	assert.NoError(t, err)
+	buf.Close()
+	assert.Equal(t, []Sizer{BytesItem("foo"), StringItem("bar"), BytesItem("bazqux")}, h.items)
+
+	files, _ = filepath.Glob(filepath.Join(dir, "buffer.*"))
+	assert.Len(t, files, 0)
+}
+
+func TestFileRestoreCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluxion-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &Options{Type: "file", Path: dir, MaxChunkSize: 500, FlushInterval: Duration(time.Hour), Compress: CompressZstd}
+	opts.SetDefault()
+
+	item := BytesItem(strings.Repeat(`{"message":"hello"}`, 10))
+	h := &testHandler{err: errors.New("unavailable")}
+	buf, err := NewFile(opts, h, nil)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, buf.Push(item))
+	}
+	buf.Close()
+
+	h = &testHandler{}
+	buf, err = NewFile(opts, h, nil)
+	assert.NoError(t, err)
+	buf.Close()
+	assert.Equal(t, []Sizer{item, item, item}, h.items)
+}
+
+// taggedItem wraps an item with a tag, like items carrying acknowledgements.
+type taggedItem struct {
+	Sizer
+	tag string
+}
+
+func (i *taggedItem) Unwrap() Sizer {
+	return i.Sizer
+}
+
+func (i *taggedItem) Wrap(s Sizer) Sizer {
+	return &taggedItem{s, i.tag}
+}
+
+func (i *taggedItem) ItemType() byte {
+	return 't'
+}
+
+func (i *taggedItem) MarshalBinary() ([]byte, error) {
+	b, _ := i.Sizer.(BytesItem)
+	return append([]byte{byte(len(i.tag))}, append([]byte(i.tag), b...)...), nil
+}
+
+func init() {
+	RegisterItem('t', func(b []byte) (Sizer, error) {
+		n := int(b[0]) + 1
+		return &taggedItem{BytesItem(b[n:]), string(b[1:n])}, nil
+	})
+}
+
+func TestFileRestoreWrapped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluxion-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &Options{Type: "file", Path: dir, MaxChunkSize: 500, FlushInterval: Duration(time.Hour), RetryInterval: Duration(time.Hour), Compress: CompressGzip}
+	opts.SetDefault()
+
+	item := BytesItem(strings.Repeat(`{"message":"hello"}`, 10))
+	ch := &compressedHandler{}
+	ch.err = errors.New("unavailable")
+	buf, err := NewFile(opts, ch, nil)
+	assert.NoError(t, err)
+	var items []Sizer
+	for _, tag := range []string{"a", "b", "c"} {
+		items = append(items, &taggedItem{item, tag})
+		assert.NoError(t, buf.Push(items[len(items)-1]))
+	}
+	buf.Close()
+	// Chunks are compressed with the wrappers
+	var tags []string
+	for _, c := range ch.chunks {
+		for _, w := range c.Wrappers {
+			tags = append(tags, w.(*taggedItem).tag)
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, tags)
+
+	h := &testHandler{}
+	buf, err = NewFile(opts, h, nil)
+	assert.NoError(t, err)
+	buf.Close()
+	assert.Equal(t, items, h.items)
+}
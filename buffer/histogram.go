@@ -0,0 +1,39 @@
+package buffer
+
+import "time"
+
+// FlushLatencyBounds are the upper bounds in seconds of the flush latency
+// histogram.
+var FlushLatencyBounds = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observed values by buckets. Counts[i] is the number of
+// values less than or equal to Bounds[i], but greater than the previous bound.
+// The last count is for values greater than all bounds.
+type Histogram struct {
+	Bounds []float64 `codec:"bounds"`
+	Counts []int64   `codec:"counts"`
+	Sum    float64   `codec:"sum"`
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		Bounds: bounds,
+		Counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i := 0
+	for i < len(h.Bounds) && v > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += v
+}
+
+func (h *Histogram) copy() *Histogram {
+	c := *h
+	c.Counts = append([]int64(nil), h.Counts...)
+	return &c
+}
@@ -0,0 +1,90 @@
+package buffer
+
+import "sync"
+
+// globalLimiter restricts the total size of items held by all buffers in the
+// process. The limit is set by Options.GlobalLimitSize.
+var globalLimiter = newLimiter(0)
+
+// limiter counts bytes held by buffers. Waiters are woken up by closing the
+// channel returned by wait when some bytes are released.
+type limiter struct {
+	limit int64
+	used  int64
+	freed chan struct{}
+	m     sync.Mutex
+}
+
+func newLimiter(limit int64) *limiter {
+	return &limiter{
+		limit: limit,
+		freed: make(chan struct{}),
+	}
+}
+
+func (l *limiter) setLimit(n int64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.limit = n
+}
+
+// tryOrWait reports whether n bytes can be acquired without exceeding the
+// limit. Zero limit means unlimited. If they can't, the channel closed by the
+// next release is returned as well. It is taken under the same lock as the
+// check, so that a release in between is never missed.
+func (l *limiter) tryOrWait(n int64) (bool, <-chan struct{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.limit <= 0 || l.used+n <= l.limit {
+		return true, nil
+	}
+	return false, l.freed
+}
+
+func (l *limiter) acquire(n int64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.used += n
+}
+
+func (l *limiter) release(n int64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.used -= n
+	l.wake()
+}
+
+func (l *limiter) broadcast() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.wake()
+}
+
+// wake wakes up all waiters. This function assumes called inside locked
+// block.
+func (l *limiter) wake() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+func (l *limiter) wait() <-chan struct{} {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.freed
+}
+
+// usage returns the ratio of used bytes to the limit, zero if unlimited.
+func (l *limiter) usage() float64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.limit <= 0 {
+		return 0
+	}
+	return float64(l.used) / float64(l.limit)
+}
+
+func (l *limiter) size() int64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.used
+}
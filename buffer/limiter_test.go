@@ -0,0 +1,25 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterWait(t *testing.T) {
+	l := newLimiter(4)
+	l.acquire(4)
+	ok, wait := l.tryOrWait(1)
+	assert.False(t, ok)
+
+	// The release after the check closes the channel taken by the check
+	l.release(4)
+	select {
+	case <-wait:
+	default:
+		t.Fatal("Release is missed")
+	}
+	ok, wait = l.tryOrWait(4)
+	assert.True(t, ok)
+	assert.Nil(t, wait)
+}
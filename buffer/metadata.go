@@ -0,0 +1,68 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Metadata holds the values of chunk keys shared by all items in a chunk.
+type Metadata struct {
+	Tag     string            `json:"tag,omitempty"`
+	Timekey time.Time         `json:"timekey"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Key returns a string identifying the chunk which the metadata belongs to.
+func (m *Metadata) Key() string {
+	if m == nil {
+		return ""
+	}
+	b := new(bytes.Buffer)
+	b.WriteString(m.Tag)
+	b.WriteByte(0)
+	if !m.Timekey.IsZero() {
+		b.WriteString(strconv.FormatInt(m.Timekey.UnixNano(), 10))
+	}
+	b.WriteByte(0)
+
+	keys := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(m.Fields[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Metadata returns the metadata of an item made from the event according to
+// the chunk keys. It returns nil if no chunk key is configured.
+func (o *Options) Metadata(tag string, t time.Time, record map[string]interface{}) *Metadata {
+	if len(o.ChunkKeys) == 0 {
+		return nil
+	}
+	m := &Metadata{}
+	for _, k := range o.ChunkKeys {
+		switch k {
+		case "tag":
+			m.Tag = tag
+		case "time":
+			m.Timekey = t.Truncate(time.Duration(o.Timekey))
+		default:
+			if m.Fields == nil {
+				m.Fields = make(map[string]string)
+			}
+			if v, ok := record[k]; ok {
+				m.Fields[k] = fmt.Sprint(v)
+			}
+		}
+	}
+	return m
+}
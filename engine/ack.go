@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+var errUnitClosed = errors.New("Unit closed")
+
+// flights counts copies of each event emitted with an origin which are not
+// acknowledged by outputs yet.
+type flights struct {
+	counts map[message.Origin]int
+	m      sync.Mutex
+}
+
+// deliver adds n copies of the events in flight. Origins whose copies are all
+// delivered are acknowledged to the inputs.
+func (e *Engine) deliver(n int, origins ...message.Origin) {
+	var done []message.Origin
+	e.flights.m.Lock()
+	for _, o := range origins {
+		c := e.flights.counts[o] + n
+		if c > 0 {
+			e.flights.counts[o] = c
+			continue
+		}
+		delete(e.flights.counts, o)
+		done = append(done, o)
+	}
+	e.flights.m.Unlock()
+	if len(done) > 0 {
+		e.ackInputs(done)
+	}
+}
+
+// delivered is a shorthand of deliver for a copy of the event.
+func (e *Engine) delivered(ev *message.Event) {
+	if ev.Origin != nil {
+		e.deliver(-1, *ev.Origin)
+	}
+}
+
+func (e *Engine) ackInputs(origins []message.Origin) {
+	byUnit := make(map[int32][]message.Origin)
+	for _, o := range origins {
+		byUnit[o.Unit] = append(byUnit[o.Unit], o)
+	}
+
+	e.rm.RLock()
+	defer e.rm.RUnlock()
+	for _, units := range e.units {
+		for _, u := range units {
+			l, ok := byUnit[u.ID]
+			if !ok || !u.ins.isInput() {
+				continue
+			}
+			// Acks are meaningless to the restarted process, it's skipped
+			// until the plugin becomes ready.
+			if u.ins.supports(message.CapAck) {
+				u.ins.wp.Write(&message.Message{Type: message.TypAck, UnitID: u.ID, Payload: l})
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+// checkUnit is a plugin section, or the secondary output of it, to be
+// initialized by Check.
+type checkUnit struct {
+	loc   string
+	conf  map[string]interface{}
+	bopts *buffer.Options
+}
+
+// Check validates the config, then initializes each plugin unit with it
+// without starting anything. Every error found is returned as Errors.
+func Check(conf *Config) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if err := conf.lookPlugins(); err != nil {
+		return err
+	}
+	dirs := &pluginDirs{dirs: conf.Engine.PluginDir}
+
+	defaultBuf := &buffer.Options{}
+	defaultBuf.SetDefault()
+	bufs := map[string]*buffer.Options{"default": defaultBuf}
+	for _, opts := range conf.Buffer {
+		o := *opts
+		o.SetDefault()
+		bufs[o.Name] = &o
+	}
+	bufferOptions := func(conf map[string]interface{}) *buffer.Options {
+		if name, ok := conf["buffer"].(string); ok {
+			return bufs[name]
+		}
+		return bufs["default"]
+	}
+
+	var names []string
+	units := make(map[string][]*checkUnit)
+	add := func(name string, u *checkUnit) {
+		if _, ok := units[name]; !ok {
+			names = append(names, name)
+		}
+		units[name] = append(units[name], u)
+	}
+	for _, s := range conf.sections() {
+		name := pluginName(s.kind, s.conf)
+		switch s.kind {
+		case "input", "filter":
+			add(name, &checkUnit{s.String(), s.conf, nil})
+		default:
+			add(name, &checkUnit{s.String(), s.conf, bufferOptions(s.conf)})
+			if sconf, ok := s.conf["secondary"].(map[string]interface{}); ok {
+				loc := s.String() + ": secondary"
+				add(pluginName(s.kind, sconf), &checkUnit{loc, sconf, bufferOptions(sconf)})
+			}
+		}
+	}
+
+	var errs Errors
+	for _, name := range names {
+		var results []error
+		if f, ok := plugin.EmbeddedPlugins[name]; ok {
+			err := compatible(name, plugin.Info(f))
+			for _, u := range units[name] {
+				if err == nil {
+					results = append(results, plugin.Check(f, name, encodeConf(u.conf), u.bopts))
+				} else {
+					results = append(results, err)
+				}
+			}
+		} else {
+			var err error
+			if results, err = checkProcess(dirs, name, units[name]); err != nil {
+				// The plugin is unavailable for every unit
+				results = make([]error, len(units[name]))
+				for i := range results {
+					results[i] = err
+				}
+			}
+		}
+		for i, err := range results {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %v", units[name][i].loc, name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// negotiate exchanges the info with the plugin process, then switches the
+// pipes to the negotiated version.
+func negotiate(rp, wp *pipe.InterProcess) (*message.PluginInfo, error) {
+	rp.SetVersion(message.MinProtoVer)
+	wp.SetVersion(message.MinProtoVer)
+	if err := wp.Write(&message.Message{Type: message.TypInfoRequest, Payload: engineInfo}); err != nil {
+		return nil, err
+	}
+	for {
+		m, err := rp.Read()
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == message.TypInfoResponse {
+			info := engineInfo.Negotiate(m.Payload.(*message.PluginInfo))
+			rp.SetVersion(info.ProtoVer)
+			wp.SetVersion(info.ProtoVer)
+			return info, nil
+		}
+	}
+}
+
+// checkProcess runs the plugin process to initialize the units, and returns
+// the result of each unit.
+func checkProcess(dirs *pluginDirs, name string, units []*checkUnit) ([]error, error) {
+	path, err := dirs.look(name)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer cmd.Wait()
+	defer w.Close()
+
+	rp := pipe.NewInterProcess(r, nil)
+	wp := pipe.NewInterProcess(nil, w)
+	info, err := negotiate(rp, wp)
+	if err != nil {
+		return nil, err
+	}
+	if err = compatible(name, info); err != nil {
+		return nil, err
+	}
+	if !info.Has(message.CapCheck) {
+		// Older plugins can't initialize units without starting them
+		return make([]error, len(units)), nil
+	}
+	for i, u := range units {
+		req := &message.CheckRequest{Config: encodeConf(u.conf), Buffer: u.bopts}
+		if err = wp.Write(&message.Message{Type: message.TypCheck, UnitID: int32(i), Payload: req}); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]error, len(units))
+	for n := 0; n < len(units); {
+		m, err := rp.Read()
+		if err != nil {
+			return nil, err
+		}
+		if m.Type != message.TypCheckResult || int(m.UnitID) >= len(units) {
+			continue
+		}
+		if s, _ := m.Payload.(string); s != "" {
+			results[m.UnitID] = errors.New(s)
+		}
+		n++
+	}
+	return results, nil
+}
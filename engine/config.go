@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yosisa/fluxion/buffer"
+)
+
+// Config is the configuration of the engine read from a TOML file.
+type Config struct {
+	Engine struct {
+		BufferLimitSize buffer.HumanSize `toml:"buffer_limit_size"`
+		// Checksum messages to and from plugin processes started afterwards
+		PipeChecksum bool `toml:"pipe_checksum"`
+		// Directories searched for plugin executables before PATH
+		PluginDir []string `toml:"plugin_dir"`
+	}
+	Monitor struct {
+		// Address of the monitoring API, disabled if empty
+		Bind string `toml:"bind"`
+	}
+	Supervisor struct {
+		SupervisorOptions
+		// Overrides by plugin name, such as out-forward
+		Plugin map[string]*SupervisorOptions `toml:"plugin"`
+	}
+	Buffer []*buffer.Options
+	Input  []map[string]interface{}
+	Filter []map[string]interface{}
+	// Output groups by name, the [[output]] group is named ""
+	Output map[string][]map[string]interface{} `toml:"-"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{Output: make(map[string][]map[string]interface{})}
+	if _, err = toml.Decode(string(b), conf); err != nil {
+		return nil, err
+	}
+
+	// To support `output:...` form, re-decoding with relax type is needed.
+	var c map[string]interface{}
+	toml.Decode(string(b), &c)
+	for k, v := range c {
+		keys := strings.SplitN(k, ":", 2)
+		if strings.ToLower(keys[0]) != "output" {
+			continue
+		}
+		confs, ok := v.([]map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of tables", k)
+		}
+
+		var name string
+		if len(keys) == 2 {
+			name = keys[1]
+		}
+		conf.Output[name] = append(conf.Output[name], confs...)
+	}
+	return conf, nil
+}
+
+// Errors holds every error found in the config.
+type Errors []error
+
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// section is a plugin section in the config. The index is 1-based.
+type section struct {
+	kind  string
+	index int
+	conf  map[string]interface{}
+}
+
+func (s *section) String() string {
+	return fmt.Sprintf("[[%s]] #%d", s.kind, s.index)
+}
+
+// sections returns all plugin sections in the order of the config file, except
+// outputs which are sorted by their group name.
+func (c *Config) sections() []*section {
+	var ss []*section
+	add := func(kind string, confs []map[string]interface{}) {
+		for i, conf := range confs {
+			ss = append(ss, &section{kind, i + 1, conf})
+		}
+	}
+	add("input", c.Input)
+	add("filter", c.Filter)
+	names := make([]string, 0, len(c.Output))
+	for name := range c.Output {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kind := "output"
+		if name != "" {
+			kind += ":" + name
+		}
+		add(kind, c.Output[name])
+	}
+	return ss
+}
+
+// Validate checks the configuration without starting any plugin. All errors
+// found are returned as Errors.
+func (c *Config) Validate() error {
+	var errs Errors
+	bufs := map[string]bool{"default": true}
+	// Paths of file buffers by name
+	fileBufs := make(map[string]string)
+	for i, opts := range c.Buffer {
+		name := opts.Name
+		if name == "" {
+			name = "default"
+		}
+		bufs[name] = true
+		if opts.Type == "file" {
+			fileBufs[name] = opts.Path
+		}
+		switch opts.Type {
+		case "", "memory", "file":
+		default:
+			errs = append(errs, fmt.Errorf("[[buffer]] #%d: Unknown buffer type: %s", i+1, opts.Type))
+		}
+	}
+
+	if err := c.Supervisor.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("[supervisor]: %v", err))
+	}
+	for _, name := range sortedNames(c.Supervisor.Plugin) {
+		if err := c.Supervisor.Plugin[name].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("[supervisor.plugin.%s]: %v", name, err))
+		}
+	}
+
+	for _, s := range c.sections() {
+		switch s.kind {
+		case "input":
+			errs = s.validate(errs, nil, false)
+		case "filter":
+			errs = s.validate(errs, nil, true)
+		default:
+			errs = s.validate(errs, bufs, true)
+		}
+	}
+	if len(errs) == 0 {
+		errs = c.validateBufferDirs(fileBufs)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateBufferDirs refuses output units sharing a file buffer directory,
+// which would restore and write the chunks of each other.
+func (c *Config) validateBufferDirs(fileBufs map[string]string) (errs Errors) {
+	used := make(map[string]string)
+	check := func(loc string, conf map[string]interface{}) {
+		bufName, ok := conf["buffer"].(string)
+		if !ok {
+			bufName = "default"
+		}
+		path, ok := fileBufs[bufName]
+		if !ok {
+			return
+		}
+		name := "out-" + conf["type"].(string)
+		wc, _ := parseWorkers(conf)
+		for k := 0; k < wc.workers; k++ {
+			dir := filepath.Join(path, bufferDir(name, k, conf))
+			if prev, ok := used[dir]; ok {
+				errs = append(errs, fmt.Errorf("%s: buffer directory %s is also used by %s, set a distinct id", loc, dir, prev))
+				return
+			}
+			used[dir] = loc
+		}
+	}
+	for _, s := range c.sections() {
+		if s.kind == "input" || s.kind == "filter" {
+			continue
+		}
+		check(s.String(), s.conf)
+		if sconf, ok := s.conf["secondary"].(map[string]interface{}); ok {
+			check(s.String()+": secondary", sconf)
+		}
+	}
+	return
+}
+
+func sortedNames(m map[string]*SupervisorOptions) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *section) validate(errs Errors, bufs map[string]bool, match bool) Errors {
+	if err := validatePlugin(s.conf, bufs, match); err != nil {
+		errs = append(errs, fmt.Errorf("%v: %v", s, err))
+	}
+	if bufs == nil {
+		return errs
+	}
+	if v, ok := s.conf["secondary"]; ok {
+		sconf, ok := v.(map[string]interface{})
+		if !ok {
+			return append(errs, fmt.Errorf("%v: secondary must be a table", s))
+		}
+		if err := validatePlugin(sconf, bufs, false); err != nil {
+			errs = append(errs, fmt.Errorf("%v: secondary: %v", s, err))
+		}
+	}
+	return errs
+}
+
+func validatePlugin(conf map[string]interface{}, bufs map[string]bool, match bool) error {
+	typ, ok := conf["type"].(string)
+	if !ok || typ == "" {
+		return errors.New("type is required")
+	}
+	if match {
+		pattern, ok := conf["match"].(string)
+		if !ok {
+			return fmt.Errorf("%s: match is required", typ)
+		}
+		if _, err := compileMatch(pattern); err != nil {
+			return fmt.Errorf("%s: %v", typ, err)
+		}
+		if _, err := parseWorkers(conf); err != nil {
+			return fmt.Errorf("%s: %v", typ, err)
+		}
+	} else if _, ok := conf["workers"]; ok {
+		return fmt.Errorf("%s: workers is only supported by filters and outputs", typ)
+	}
+	if bufs != nil {
+		if v, ok := conf["buffer"]; ok {
+			if name, ok := v.(string); !ok || !bufs[name] {
+				return fmt.Errorf("%s: No such buffer defined: %v", typ, v)
+			}
+		}
+	}
+	if v, ok := conf["id"]; ok {
+		if id, ok := v.(string); !ok || id == "" || strings.ContainsAny(id, "/\\") {
+			return fmt.Errorf("%s: id must be a non-empty string without slashes", typ)
+		}
+	}
+	if v, ok := conf["copy_mode"]; ok {
+		var m CopyMode
+		mode, ok := v.(string)
+		if !ok || m.UnmarshalText([]byte(mode)) != nil {
+			return fmt.Errorf("%s: copy_mode must be no_copy, shallow or deep", typ)
+		}
+	}
+	return nil
+}
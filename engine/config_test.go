@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+func TestValidate(t *testing.T) {
+	conf := &Config{
+		Buffer: []*buffer.Options{{Name: "mem"}, {Name: "bad", Type: "disk"}},
+		Input:  []map[string]interface{}{{"type": "forward"}, {}, {"type": "tail", "workers": int64(2)}},
+		Filter: []map[string]interface{}{{"type": "js", "match": "foo.{"}},
+		Output: map[string][]map[string]interface{}{
+			"": {{"type": "stdout", "match": "**", "buffer": "mem"}},
+			"es": {{
+				"type":      "stdout",
+				"match":     "**",
+				"copy_mode": "none",
+				"secondary": map[string]interface{}{"type": "file", "buffer": "nothing"},
+			}},
+		},
+	}
+	err := conf.Validate()
+	if assert.IsType(t, Errors{}, err) {
+		errs := err.(Errors)
+		assert.Len(t, errs, 6)
+		assert.Contains(t, errs[0].Error(), "[[buffer]] #2")
+		assert.Contains(t, errs[1].Error(), "[[input]] #2: type is required")
+		assert.Contains(t, errs[2].Error(), "[[input]] #3: tail: workers is only supported")
+		assert.Contains(t, errs[3].Error(), "[[filter]] #1: js:")
+		assert.Contains(t, errs[4].Error(), "[[output:es]] #1: stdout: copy_mode")
+		assert.Contains(t, errs[5].Error(), "[[output:es]] #1: secondary: file: No such buffer")
+	}
+
+	conf.Buffer = conf.Buffer[:1]
+	conf.Input = conf.Input[:1]
+	conf.Filter = nil
+	delete(conf.Output, "es")
+	assert.NoError(t, conf.Validate())
+}
+
+func TestBufferDirs(t *testing.T) {
+	es := func() map[string]interface{} {
+		return map[string]interface{}{"type": "elasticsearch", "match": "**", "index": "logs"}
+	}
+	conf := &Config{
+		Buffer: []*buffer.Options{{Type: "file", Path: "/var/lib/fluxion"}},
+		Output: map[string][]map[string]interface{}{"": {es(), es()}},
+	}
+	err := conf.Validate()
+	if assert.IsType(t, Errors{}, err) {
+		assert.Contains(t, err.Error(), "[[output]] #2: buffer directory")
+		assert.Contains(t, err.Error(), "also used by [[output]] #1")
+	}
+	conf.Output[""][1]["id"] = "archive"
+	assert.NoError(t, conf.Validate())
+	conf.Output[""][1]["id"] = "../x"
+	assert.Error(t, conf.Validate())
+
+	// Directories don't depend on the order of sections nor unit IDs
+	dir := bufferDir("out-elasticsearch", 0, es())
+	assert.Equal(t, dir, bufferDir("out-elasticsearch", 0, es()))
+	assert.NotEqual(t, dir, bufferDir("out-elasticsearch", 1, es()))
+	assert.Equal(t, "out-elasticsearch.archive", bufferDir("out-elasticsearch", 0, map[string]interface{}{"id": "archive"}))
+}
+
+func TestLookPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluxion-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fluxion-out-found")
+	ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "fluxion-out-noexec"), nil, 0644)
+	plugin.EmbeddedPlugins["in-embedded"] = func() plugin.Plugin { return nil }
+	defer delete(plugin.EmbeddedPlugins, "in-embedded")
+
+	dirs := &pluginDirs{dirs: []string{dir}}
+	p, err := dirs.look("out-found")
+	assert.NoError(t, err)
+	assert.Equal(t, path, p)
+	_, err = dirs.look("out-noexec")
+	assert.Error(t, err)
+
+	conf := &Config{
+		Input: []map[string]interface{}{{"type": "embedded"}},
+		Output: map[string][]map[string]interface{}{
+			"": {{"type": "found", "match": "**", "secondary": map[string]interface{}{"type": "typo"}}},
+		},
+	}
+	conf.Engine.PluginDir = []string{dir}
+	err = conf.lookPlugins()
+	if assert.IsType(t, Errors{}, err) {
+		errs := err.(Errors)
+		assert.Len(t, errs, 1)
+		assert.Equal(t, "[[output]] #1: secondary: out-typo plugin not found in plugin_dir or PATH", errs[0].Error())
+	}
+
+	// Plugins failed to respond are listed with the error
+	var found *PluginEntry
+	for _, e := range ListPlugins([]string{dir}) {
+		if e.Name == "out-found" && e.Path == path {
+			found = e
+		}
+	}
+	if assert.NotNil(t, found) {
+		assert.Error(t, found.Err)
+		assert.Nil(t, found.Info)
+	}
+}
@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+// Plugin executables are named with the prefix followed by the plugin name
+const pluginPrefix = "fluxion-"
+
+const probeTimeout = 3 * time.Second
+
+// pluginDirs are searched for plugin executables before PATH.
+type pluginDirs struct {
+	dirs []string
+	m    sync.Mutex
+}
+
+func (d *pluginDirs) set(dirs []string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.dirs = dirs
+}
+
+func (d *pluginDirs) list() []string {
+	if d == nil {
+		return nil
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.dirs
+}
+
+// look returns the path of the plugin executable.
+func (d *pluginDirs) look(name string) (string, error) {
+	file := pluginPrefix + name
+	for _, dir := range d.list() {
+		path := filepath.Join(dir, file)
+		if isExecutable(path) {
+			return path, nil
+		}
+	}
+	path, err := exec.LookPath(file)
+	if err != nil {
+		return "", fmt.Errorf("%s plugin not found in plugin_dir or PATH", name)
+	}
+	return path, nil
+}
+
+func isExecutable(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0
+}
+
+// pluginName returns the name of the plugin for the section kind.
+func pluginName(kind string, conf map[string]interface{}) string {
+	typ, _ := conf["type"].(string)
+	switch kind {
+	case "input":
+		return "in-" + typ
+	case "filter":
+		return "filter-" + typ
+	}
+	return "out-" + typ
+}
+
+// lookPlugins returns an error for each plugin neither embedded nor found.
+func (c *Config) lookPlugins() error {
+	dirs := &pluginDirs{dirs: c.Engine.PluginDir}
+	var errs Errors
+	look := func(loc, name string) {
+		if _, ok := plugin.EmbeddedPlugins[name]; ok {
+			return
+		}
+		if _, err := dirs.look(name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", loc, err))
+		}
+	}
+	for _, s := range c.sections() {
+		look(s.String(), pluginName(s.kind, s.conf))
+		if sconf, ok := s.conf["secondary"].(map[string]interface{}); ok {
+			look(s.String()+": secondary", pluginName(s.kind, sconf))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// PluginEntry is a plugin found by ListPlugins.
+type PluginEntry struct {
+	Name string
+	// Path of the executable, empty if embedded
+	Path string
+	// Nil if the plugin failed to respond
+	Info *message.PluginInfo
+	Err  error
+	// Set if hidden by another plugin of the same name found earlier
+	Shadowed bool
+}
+
+// ListPlugins returns the embedded plugins, and the plugins found in the dirs
+// and PATH in the search order. Each plugin process is started to ask its
+// info.
+func ListPlugins(dirs []string) []*PluginEntry {
+	var entries []*PluginEntry
+	seen := make(map[string]bool)
+	var names []string
+	for name := range plugin.EmbeddedPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		seen[name] = true
+		entries = append(entries, &PluginEntry{Name: name, Info: plugin.Info(plugin.EmbeddedPlugins[name])})
+	}
+
+	for _, dir := range append(dirs, filepath.SplitList(os.Getenv("PATH"))...) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range files {
+			path := filepath.Join(dir, fi.Name())
+			if !strings.HasPrefix(fi.Name(), pluginPrefix) || !isExecutable(path) {
+				continue
+			}
+			entry := &PluginEntry{Name: strings.TrimPrefix(fi.Name(), pluginPrefix), Path: path}
+			if entry.Shadowed = seen[entry.Name]; !entry.Shadowed {
+				entry.Info, entry.Err = probe(path)
+			}
+			seen[entry.Name] = true
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// probe runs the plugin executable to ask its info.
+func probe(path string) (*message.PluginInfo, error) {
+	cmd := exec.Command(path)
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer cmd.Wait()
+	defer w.Close()
+
+	type result struct {
+		info *message.PluginInfo
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		info, err := negotiate(pipe.NewInterProcess(r, nil), pipe.NewInterProcess(nil, w))
+		c <- result{info, err}
+	}()
+	select {
+	case res := <-c:
+		return res.info, res.err
+	case <-time.After(probeTimeout):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("no response in %v", probeTimeout)
+	}
+}
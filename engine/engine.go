@@ -1,52 +1,64 @@
 package engine
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
 	glog "log"
 	"os"
 	"os/signal"
-	"regexp"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
-	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/yosisa/fluxion/buffer"
 	"github.com/yosisa/fluxion/log"
 	"github.com/yosisa/fluxion/message"
 	"github.com/yosisa/fluxion/pipe"
 	"github.com/yosisa/fluxion/plugin"
-	"github.com/yosisa/pave/process"
 )
 
 type Engine struct {
-	pm      *process.ProcessManager
 	plugins map[string]*Instance
 	embeds  []*Instance
-	units   []*ExecUnit
+	units   map[string][]*ExecUnit
+	reuse   map[string][]*ExecUnit
 	filters []*ExecUnit
 	tr      map[string]*TagRouter
 	ftr     *TagRouter
 	bufs    map[string]*buffer.Options
 	unitID  int32
+	limit   buffer.HumanSize
+	monitor string
+	sup     *SupervisorOptions
+	sups    map[string]*SupervisorOptions
+	path    string
+	started bool
 	log     *log.Logger
 	stopped chan struct{}
+	// Guards routers, it's held while loading config
+	rm sync.RWMutex
+	// Output units asking to pause inputs
+	pausedBy map[*ExecUnit]bool
+	pm       sync.Mutex
+	flights  flights
+	// Whether frames to plugin processes are checksummed, accessed atomically
+	checksum int32
+	dirs     pluginDirs
 }
 
 func New() *Engine {
-	defaultBuf := &buffer.Options{}
-	defaultBuf.SetDefault()
 	e := &Engine{
-		pm:      process.NewProcessManager(process.StrategyRestartOnError, 3*time.Second),
-		plugins: make(map[string]*Instance),
-		tr:      make(map[string]*TagRouter),
-		ftr:     &TagRouter{},
-		bufs: map[string]*buffer.Options{
-			"default": defaultBuf,
-		},
-		stopped: make(chan struct{}),
+		plugins:  make(map[string]*Instance),
+		units:    make(map[string][]*ExecUnit),
+		stopped:  make(chan struct{}),
+		pausedBy: make(map[*ExecUnit]bool),
+		flights:  flights{counts: make(map[message.Origin]int)},
 	}
+	e.resetRoutes()
 	e.log = &log.Logger{
 		Name:     "engine",
 		Prefix:   "[engine] ",
@@ -55,122 +67,494 @@ func New() *Engine {
 	return e
 }
 
+func (e *Engine) resetRoutes() {
+	defaultBuf := &buffer.Options{}
+	defaultBuf.SetDefault()
+	e.bufs = map[string]*buffer.Options{
+		"default": defaultBuf,
+	}
+	e.tr = make(map[string]*TagRouter)
+	e.ftr = &TagRouter{}
+	e.filters = nil
+}
+
+// Load reads the config file and registers everything in it. The file is
+// read again on SIGHUP.
+func (e *Engine) Load(path string) error {
+	conf, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	e.path = path
+	return e.Apply(conf)
+}
+
+// Apply applies the config. Units whose config is not changed since the last
+// Apply are kept running, so that their buffers are not lost. Others are
+// started or stopped, then all routers are rebuilt.
+func (e *Engine) Apply(conf *Config) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if err := conf.lookPlugins(); err != nil {
+		return err
+	}
+
+	e.rm.Lock()
+	e.reuse, e.units = e.units, make(map[string][]*ExecUnit)
+	e.resetRoutes()
+	e.limit = conf.Engine.BufferLimitSize
+	var checksum int32
+	if conf.Engine.PipeChecksum {
+		checksum = 1
+	}
+	atomic.StoreInt32(&e.checksum, checksum)
+	e.dirs.set(conf.Engine.PluginDir)
+	e.monitor = conf.Monitor.Bind
+	e.setSupervisor(conf)
+	for _, opts := range conf.Buffer {
+		e.RegisterBuffer(opts)
+	}
+	for _, c := range conf.Input {
+		e.RegisterInputPlugin(c)
+	}
+	var err error
+	for _, c := range conf.Filter {
+		if err = e.RegisterFilterPlugin(c); err != nil {
+			break
+		}
+	}
+	for name, confs := range conf.Output {
+		for _, c := range confs {
+			if err == nil {
+				err = e.RegisterOutputPlugin(name, c)
+			}
+		}
+	}
+	stale := e.reuse
+	e.reuse = nil
+	e.rm.Unlock()
+
+	for _, units := range stale {
+		for _, u := range units {
+			e.log.Infof("Stopping unit %d of %s plugin", u.ID, u.ins.name)
+			u.ins.RemoveExecUnit(u)
+		}
+	}
+	if e.started {
+		e.divideBufferLimit()
+		for _, units := range e.units {
+			for _, u := range units {
+				u.ins.StartExecUnit(u)
+			}
+		}
+		e.restartFailed()
+	}
+	return err
+}
+
 func (e *Engine) RegisterBuffer(opts *buffer.Options) {
 	opts.SetDefault()
 	e.bufs[opts.Name] = opts
 }
 
 func (e *Engine) pluginInstance(name string) *Instance {
-	if ins, ok := e.plugins[name]; ok {
+	return e.workerInstance(name, 0)
+}
+
+// workerInstance returns the k-th worker process of the plugin. The first one
+// is shared with units without workers.
+func (e *Engine) workerInstance(name string, k int) *Instance {
+	key := name
+	if k > 0 {
+		key = fmt.Sprintf("%s#%d", name, k)
+	}
+	if ins, ok := e.plugins[key]; ok {
 		return ins
 	}
 	ins := NewInstance(name, e)
-	e.plugins[name] = ins
+	ins.key, ins.worker = key, k
+	e.plugins[key] = ins
 
 	if f, ok := plugin.EmbeddedPlugins[name]; ok {
 		p1 := pipe.NewInProcess()
 		p2 := pipe.NewInProcess()
 		ins.rp = p1
 		ins.wp = p2
-		go plugin.New(name, f).RunWithPipe(p2, p1)
+		p := plugin.New(name, f)
+		ins.interrupt = p.Interrupt
+		go p.RunWithPipe(p2, p1)
+		ins.embedded = true
 		e.embeds = append(e.embeds, ins)
+		if e.started {
+			ins.Start()
+		}
 	} else {
-		e.pm.Add(process.New("fluxion-"+name, prepareFuncFactory(ins), func(err error) {
+		ins.proc = newProcess(name, e.supervisorOptions(name), prepareFuncFactory(ins), func(err error) {
+			if err == errGaveUp {
+				e.fail(ins)
+				return
+			}
 			e.log.Criticalf("%s plugin crashed: %v", name, err)
-		}))
+			ins.m.Lock()
+			ins.crashes++
+			ins.m.Unlock()
+		})
+		ins.proc.dirs = &e.dirs
+		if e.started {
+			ins.proc.Start()
+		}
 	}
 	return ins
 }
 
+// addExecUnit adds a unit for the config. A running unit of the same config
+// is reused on reload.
 func (e *Engine) addExecUnit(ins *Instance, conf map[string]interface{}, bopts *buffer.Options) *ExecUnit {
-	unit := ins.AddExecUnit(atomic.AddInt32(&e.unitID, 1), conf, bopts)
-	e.units = append(e.units, unit)
+	key := unitKey(ins, conf, bopts)
+	var unit *ExecUnit
+	if units := e.reuse[key]; len(units) > 0 {
+		unit, e.reuse[key] = units[0], units[1:]
+	} else {
+		unit = ins.AddExecUnit(atomic.AddInt32(&e.unitID, 1), conf, bopts)
+	}
+	e.units[key] = append(e.units[key], unit)
 	return unit
 }
 
+func unitKey(ins *Instance, conf map[string]interface{}, bopts *buffer.Options) string {
+	key := ins.key + "\n" + encodeConf(conf)
+	if bopts != nil {
+		b := new(bytes.Buffer)
+		toml.NewEncoder(b).Encode(bopts)
+		key += "\n" + b.String()
+	}
+	return key
+}
+
 func (e *Engine) RegisterInputPlugin(conf map[string]interface{}) {
 	ins := e.pluginInstance("in-" + conf["type"].(string))
 	e.addExecUnit(ins, conf, nil)
 }
 
-func (e *Engine) RegisterOutputPlugin(name string, conf map[string]interface{}) error {
+func (e *Engine) bufferOptions(conf map[string]interface{}) (*buffer.Options, error) {
 	bufName := "default"
 	if name, ok := conf["buffer"].(string); ok {
 		bufName = name
 	}
 	buf, ok := e.bufs[bufName]
 	if !ok {
-		return fmt.Errorf("No such buffer defined: %s", bufName)
+		return nil, fmt.Errorf("No such buffer defined: %s", bufName)
 	}
+	return buf, nil
+}
 
-	ins := e.pluginInstance("out-" + conf["type"].(string))
-	unit := e.addExecUnit(ins, conf, buf)
+// unitBuffer returns the buffer options of the k-th worker unit of the
+// output. File buffers are separated by unit in directories of bufferDir.
+func unitBuffer(name string, k int, conf map[string]interface{}, bopts *buffer.Options) *buffer.Options {
+	if bopts == nil || bopts.Type != "file" {
+		return bopts
+	}
+	o := *bopts
+	o.Path = filepath.Join(o.Path, bufferDir(name, k, conf))
+	return &o
+}
+
+// bufferDir names the file buffer directory of the unit by the id of the
+// section, or the hash of the section without id. Unlike unit IDs, it doesn't
+// change by the order of sections nor reloads, so that persisted chunks are
+// restored by the same output.
+func bufferDir(name string, k int, conf map[string]interface{}) string {
+	id, ok := conf["id"].(string)
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(encodeConf(conf)))
+		id = fmt.Sprintf("%016x", h.Sum64())
+	}
+	if k > 0 {
+		return fmt.Sprintf("%s.%s.%d", name, id, k)
+	}
+	return name + "." + id
+}
+
+func (e *Engine) RegisterOutputPlugin(name string, conf map[string]interface{}) error {
+	buf, err := e.bufferOptions(conf)
+	if err != nil {
+		return err
+	}
+
+	units, em, err := e.addWorkers("out-"+conf["type"].(string), conf, buf)
+	if err != nil {
+		return err
+	}
+
+	// Secondary output receives events given up by the primary output. It's
+	// shared by the workers.
+	var secondary *ExecUnit
+	if sconf, ok := conf["secondary"].(map[string]interface{}); ok {
+		sbuf, err := e.bufferOptions(sconf)
+		if err != nil {
+			return err
+		}
+		sname := "out-" + sconf["type"].(string)
+		secondary = e.addExecUnit(e.pluginInstance(sname), sconf, unitBuffer(sname, 0, sconf, sbuf))
+	}
 
 	tr, ok := e.tr[name]
 	if !ok {
 		tr = &TagRouter{}
 		e.tr[name] = tr
 	}
-	re, err := regexp.Compile(conf["match"].(string))
+	m, err := compileMatch(conf["match"].(string))
 	if err != nil {
 		return err
 	}
-	tr.Add(re, unit)
+	mode := CopyDefault
+	if v, ok := conf["copy_mode"].(string); ok {
+		if err = mode.UnmarshalText([]byte(v)); err != nil {
+			return err
+		}
+	}
+	for _, unit := range units {
+		unit.Secondary = secondary
+		unit.CopyMode = mode
+	}
+	if g, ok := em.(*workerGroup); ok {
+		g.CopyMode = mode
+	}
+	if cont, _ := conf["continue"].(bool); cont {
+		tr.AddContinue(m, em)
+	} else {
+		tr.Add(m, em)
+	}
 	return nil
 }
 
 func (e *Engine) RegisterFilterPlugin(conf map[string]interface{}) error {
-	ins := e.pluginInstance("filter-" + conf["type"].(string))
-	unit := e.addExecUnit(ins, conf, nil)
+	units, em, err := e.addWorkers("filter-"+conf["type"].(string), conf, nil)
+	if err != nil {
+		return err
+	}
 
-	re, err := regexp.Compile(conf["match"].(string))
+	m, err := compileMatch(conf["match"].(string))
 	if err != nil {
 		return err
 	}
-	e.ftr.Add(re, unit)
+	// Workers share the router, so that filtered events follow the same chain
+	router := &TagRouter{}
+	for _, unit := range units {
+		unit.Router = router
+	}
+	e.ftr.Add(m, em)
 
 	// Register new filter to the preceding filters
 	for _, f := range e.filters {
-		f.Router.Add(re, unit)
+		f.Router.Add(m, em)
 	}
-	e.filters = append(e.filters, unit)
+	e.filters = append(e.filters, units[0])
 	return nil
 }
 
 func (e *Engine) Filter(ev *message.Event) {
-	if ins := e.ftr.Route(ev.Tag); ins != nil {
-		ins.Emit(ev)
+	e.rm.RLock()
+	ins := e.ftr.Route(ev.Tag)
+	e.rm.RUnlock()
+	if ins != nil {
+		if ins.Emit(ev) != nil {
+			e.delivered(ev)
+		}
 	} else {
 		e.Emit(ev)
 	}
 }
 
+// emitChain passes the event filtered by the unit to the following filter.
+func (e *Engine) emitChain(unit *ExecUnit, ev *message.Event) {
+	e.rm.RLock()
+	next := unit.Router.Route(ev.Tag)
+	e.rm.RUnlock()
+	if next != nil {
+		if next.Emit(ev) != nil {
+			e.delivered(ev)
+		}
+	} else {
+		e.Emit(ev)
+	}
+}
+
+func (e *Engine) secondary(unit *ExecUnit) *ExecUnit {
+	e.rm.RLock()
+	defer e.rm.RUnlock()
+	return unit.Secondary
+}
+
 func (e *Engine) Emit(ev *message.Event) {
+	var emitters []Emitter
+	e.rm.RLock()
 	for _, tr := range e.tr {
-		if ins := tr.Route(ev.Tag); ins != nil {
-			ins.Emit(ev)
+		emitters = append(emitters, tr.RouteAll(ev.Tag)...)
+	}
+	e.rm.RUnlock()
+	if ev.Origin != nil {
+		// The event itself is counted by the input
+		e.deliver(len(emitters)-1, *ev.Origin)
+	}
+
+	// Since embedded plugins share the event through the pipe, every copy is
+	// made before emitting, so that no one modifies the event being copied.
+	shared := len(emitters) > 1
+	evs := make([]*message.Event, len(emitters))
+	for i, em := range emitters {
+		mode := CopyDefault
+		switch typed := em.(type) {
+		case *ExecUnit:
+			mode = typed.CopyMode
+		case *workerGroup:
+			mode = typed.CopyMode
+		}
+		evs[i] = copyEvent(ev, mode, shared)
+	}
+	for i, em := range emitters {
+		if em.Emit(evs[i]) != nil {
+			e.delivered(evs[i])
+		}
+	}
+}
+
+func copyEvent(ev *message.Event, mode CopyMode, shared bool) *message.Event {
+	switch mode {
+	case CopyDefault:
+		if shared {
+			return ev.DeepCopy()
+		}
+	case CopyShallow:
+		return ev.Copy()
+	case CopyDeep:
+		return ev.DeepCopy()
+	}
+	return ev
+}
+
+// pause pauses all inputs while any output unit is under pressure.
+func (e *Engine) pause(u *ExecUnit) {
+	e.pm.Lock()
+	defer e.pm.Unlock()
+	if e.pausedBy[u] {
+		return
+	}
+	e.pausedBy[u] = true
+	if len(e.pausedBy) == 1 {
+		e.log.Warningf("Inputs paused by unit %d of %s plugin", u.ID, u.ins.name)
+		e.sendInputs(&message.Message{Type: message.TypPause})
+	}
+}
+
+func (e *Engine) resume(u *ExecUnit) {
+	e.pm.Lock()
+	defer e.pm.Unlock()
+	if !e.pausedBy[u] {
+		return
+	}
+	delete(e.pausedBy, u)
+	if len(e.pausedBy) == 0 {
+		e.log.Info("Inputs resumed")
+		e.sendInputs(&message.Message{Type: message.TypResume})
+	}
+}
+
+func (e *Engine) paused() bool {
+	e.pm.Lock()
+	defer e.pm.Unlock()
+	return len(e.pausedBy) > 0
+}
+
+func (e *Engine) sendInputs(m *message.Message) {
+	e.rm.RLock()
+	defer e.rm.RUnlock()
+	for _, ins := range e.plugins {
+		if !ins.isInput() {
+			continue
+		}
+		if ins.supports(message.CapPause) {
+			ins.wp.Write(m)
 		}
 	}
 }
 
 func (e *Engine) Start() {
+	e.divideBufferLimit()
 	for _, p := range e.embeds {
 		p.Start()
 	}
-	e.pm.Start()
+	for _, ins := range e.plugins {
+		if ins.proc != nil {
+			ins.proc.Start()
+		}
+	}
+	e.started = true
+	if e.monitor != "" {
+		if err := e.startMonitor(e.monitor); err != nil {
+			e.log.Criticalf("Failed to start monitoring API: %v", err)
+		}
+	}
 	go e.signalHandler()
 }
 
+// divideBufferLimit assigns a portion of the buffer limit to each output
+// unit. Embedded plugins share a portion since they run in this process.
+func (e *Engine) divideBufferLimit() {
+	if e.limit <= 0 {
+		return
+	}
+
+	var total, embedded int64
+	counts := make(map[*Instance]int64)
+	for _, ins := range e.plugins {
+		for _, u := range ins.units {
+			if u.bopts == nil {
+				continue
+			}
+			total++
+			counts[ins]++
+			if ins.embedded {
+				embedded++
+			}
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	for ins, n := range counts {
+		if ins.embedded {
+			n = embedded
+		}
+		limit := buffer.HumanSize(int64(e.limit) * n / total)
+		for _, u := range ins.units {
+			u.limit = limit
+		}
+	}
+}
+
 func (e *Engine) Wait() {
 	<-e.stopped
 }
 
 func (e *Engine) Stop() {
-	time.AfterFunc(10*time.Second, e.pm.Stop)
+	// Processes are killed if they don't stop within the grace period
+	for _, ins := range e.plugins {
+		if ins.proc != nil {
+			ins.proc.Stop()
+		}
+	}
 	e.stopPlugins("in-")
 	e.stopPlugins("filter-")
 	e.stopPlugins("out-")
-	e.pm.Wait()
+	for _, ins := range e.plugins {
+		if ins.proc != nil {
+			<-ins.proc.Done()
+		}
+	}
 	close(e.stopped)
 }
 
@@ -190,11 +574,29 @@ func (e *Engine) stopPlugins(prefix string) {
 }
 
 func (e *Engine) signalHandler() {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
-	for _ = range c {
-		e.Stop()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			e.reload()
+			continue
+		}
 		signal.Stop(c)
-		close(c)
+		e.Stop()
+		return
+	}
+}
+
+func (e *Engine) reload() {
+	if e.path == "" {
+		return
+	}
+	e.log.Infof("Reloading %s", e.path)
+	conf, err := LoadConfig(e.path)
+	if err == nil {
+		err = e.Apply(conf)
+	}
+	if err != nil {
+		e.log.Errorf("Failed to reload config: %v", err)
 	}
 }
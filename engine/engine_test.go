@@ -0,0 +1,363 @@
+package engine
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+// mutatingEmitter modifies the record like outputs adding fields.
+type mutatingEmitter struct {
+	key    string
+	events []*message.Event
+}
+
+func (e *mutatingEmitter) Emit(ev *message.Event) error {
+	ev.Record[e.key] = true
+	ev.Record["nested"].(map[string]interface{})[e.key] = true
+	e.events = append(e.events, ev)
+	return nil
+}
+
+func TestEmitIsolation(t *testing.T) {
+	e := New()
+	all, _ := compileMatch("**")
+	e1 := &mutatingEmitter{key: "e1"}
+	e2 := &mutatingEmitter{key: "e2"}
+	e3 := &mutatingEmitter{key: "e3"}
+	e.tr[""] = &TagRouter{}
+	e.tr[""].AddContinue(all, e1)
+	e.tr[""].Add(all, e2)
+	e.tr["other"] = &TagRouter{}
+	e.tr["other"].Add(all, e3)
+
+	ev := message.NewEvent("foo", map[string]interface{}{
+		"nested": map[string]interface{}{},
+	})
+	e.Emit(ev)
+
+	for _, em := range []*mutatingEmitter{e1, e2, e3} {
+		assert.Len(t, em.events, 1)
+		assert.Equal(t, map[string]interface{}{
+			em.key:   true,
+			"nested": map[string]interface{}{em.key: true},
+		}, em.events[0].Record)
+	}
+	assert.Equal(t, map[string]interface{}{"nested": map[string]interface{}{}}, ev.Record)
+}
+
+func TestApplyReuseUnits(t *testing.T) {
+	plugin.EmbeddedPlugins["out-test"] = func() plugin.Plugin { return nil }
+	defer delete(plugin.EmbeddedPlugins, "out-test")
+
+	output := func(path string) *Config {
+		return &Config{Output: map[string][]map[string]interface{}{
+			"": {
+				{"type": "test", "match": "foo.**", "path": "/tmp/foo"},
+				{"type": "test", "match": "**", "path": path},
+			},
+		}}
+	}
+	e := New()
+	assert.NoError(t, e.Apply(output("/tmp/a")))
+	foo := e.tr[""].Route("foo")
+	a := e.tr[""].Route("bar")
+
+	assert.NoError(t, e.Apply(output("/tmp/b")))
+	assert.True(t, foo == e.tr[""].Route("foo"))
+	b := e.tr[""].Route("bar")
+	assert.False(t, a == b)
+	assert.Len(t, e.plugins["out-test"].units, 2)
+
+	// Invalid config doesn't change anything
+	conf := output("/tmp/c")
+	conf.Output[""][1]["match"] = "{"
+	assert.Error(t, e.Apply(conf))
+	assert.True(t, b == e.tr[""].Route("bar"))
+}
+
+func TestPauseInputs(t *testing.T) {
+	e := New()
+	in := NewInstance("in-test", e)
+	wp := pipe.NewInProcess()
+	in.wp = wp
+	in.ready, in.info = true, engineInfo
+	e.plugins["in-test"] = in
+	out := NewInstance("out-test", e)
+	u1 := out.AddExecUnit(1, nil, nil)
+	u2 := out.AddExecUnit(2, nil, nil)
+
+	e.pause(u1)
+	e.pause(u2)
+	e.pause(u1)
+	m, _ := wp.Read()
+	assert.Equal(t, message.TypPause, m.Type)
+	assert.True(t, e.paused())
+
+	e.resume(u1)
+	assert.True(t, e.paused())
+	e.resume(u2)
+	m, _ = wp.Read()
+	assert.Equal(t, message.TypResume, m.Type)
+	assert.False(t, e.paused())
+}
+
+func TestDeliverAcks(t *testing.T) {
+	e := New()
+	in := NewInstance("in-test", e)
+	wp := pipe.NewInProcess()
+	in.wp = wp
+	in.ready, in.info = true, engineInfo
+	e.units["in-test"] = []*ExecUnit{in.AddExecUnit(1, nil, nil)}
+	all, _ := compileMatch("**")
+	e.tr[""] = &TagRouter{}
+	e.tr[""].AddContinue(all, &mutatingEmitter{key: "e1"})
+	e.tr[""].Add(all, &mutatingEmitter{key: "e2"})
+
+	o := message.Origin{Unit: 1, Seq: 10}
+	ev := message.NewEvent("foo", map[string]interface{}{"nested": map[string]interface{}{}})
+	ev.Origin = &o
+	e.deliver(1, o)
+	e.Emit(ev)
+	e.deliver(-1, o)
+	assert.Len(t, e.flights.counts, 1)
+	e.deliver(-1, o)
+	assert.Len(t, e.flights.counts, 0)
+	m, _ := wp.Read()
+	assert.Equal(t, message.TypAck, m.Type)
+	assert.Equal(t, int32(1), m.UnitID)
+	assert.Equal(t, []message.Origin{o}, m.Payload)
+
+	// Events routed nowhere are acknowledged immediately
+	o.Seq++
+	ev = message.NewEvent("bar", nil)
+	ev.Origin = &o
+	e.tr[""] = &TagRouter{}
+	e.deliver(1, o)
+	e.Emit(ev)
+	m, _ = wp.Read()
+	assert.Equal(t, []message.Origin{o}, m.Payload)
+}
+
+func TestReplayInflight(t *testing.T) {
+	ins := NewInstance("out-test", New())
+	u := ins.AddExecUnit(1, nil, nil)
+	defer u.close()
+	start := func() *pipe.InProcess {
+		wp := pipe.NewInProcess()
+		assert.NoError(t, u.Start(wp, engineInfo))
+		for _, typ := range []message.MessageType{message.TypBufferOption, message.TypConfigure, message.TypStart} {
+			m, _ := wp.Read()
+			assert.Equal(t, typ, m.Type)
+		}
+		return wp
+	}
+
+	wp := start()
+	u.Emit(message.NewEvent("foo", nil))
+	u.Emit(message.NewEvent("bar", nil))
+	// Events emitted at once are sent in a batch
+	m, _ := wp.Read()
+	assert.Equal(t, message.TypEventBatch, m.Type)
+	batch := m.Payload.(*message.EventBatch)
+	assert.Equal(t, []uint64{1, 2}, batch.Seqs)
+	assert.Len(t, batch.Events, 2)
+	u.inflight.confirm(batch.Seqs[0])
+	assert.Equal(t, int64(1), u.inflight.Len())
+
+	// The restarted process receives the event not confirmed
+	wp = start()
+	m, _ = wp.Read()
+	assert.Equal(t, uint64(2), m.Seq)
+	assert.Equal(t, "bar", m.Payload.(*message.Event).Tag)
+	u.Emit(message.NewEvent("baz", nil))
+	m, _ = wp.Read()
+	assert.Equal(t, uint64(3), m.Seq)
+}
+
+func TestDeadOutput(t *testing.T) {
+	e := New()
+	// The dead plugin never becomes ready
+	dead := NewInstance("out-dead", e)
+	du := dead.AddExecUnit(1, nil, nil)
+	defer du.close()
+	live := NewInstance("out-live", e)
+	live.embedded = true
+	lu := live.AddExecUnit(2, nil, nil)
+	defer lu.close()
+	wp := pipe.NewInProcess()
+	assert.NoError(t, lu.Start(wp, engineInfo))
+	for i := 0; i < 3; i++ {
+		wp.Read()
+	}
+	m, _ := compileMatch("foo.**")
+	e.tr[""] = &TagRouter{}
+	e.tr[""].AddContinue(m, du)
+	e.tr[""].Add(m, lu)
+
+	n := pendingLimit + 10
+	go func() {
+		for i := 0; i < n; i++ {
+			e.Emit(message.NewEvent("foo", nil))
+		}
+	}()
+	for received := 0; received < n; {
+		m, _ := wp.Read()
+		if m.Type == message.TypEventBatch {
+			received += len(m.Payload.(*message.EventBatch).Events)
+		} else {
+			received++
+		}
+	}
+	// The last event may be still on the way to the pending
+	dropped := func(n int64) bool {
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&du.dropped) != n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return atomic.LoadInt64(&du.dropped) == n
+	}
+	// The oldest events are dropped beyond the limit
+	assert.True(t, dropped(10))
+	assert.Equal(t, int64(pendingLimit), du.pending.Len())
+
+	// Events to the failed plugin are dropped immediately
+	dead.m.Lock()
+	dead.failed = true
+	dead.m.Unlock()
+	assert.NoError(t, du.Emit(message.NewEvent("foo", nil)))
+	assert.NoError(t, du.Emit(message.NewEvent("foo", nil)))
+	assert.True(t, dropped(12))
+	assert.Equal(t, int64(pendingLimit), du.pending.Len())
+}
+
+func TestDeliverLegacy(t *testing.T) {
+	e := New()
+	in := NewInstance("in-test", e)
+	wp := pipe.NewInProcess()
+	in.wp = wp
+	in.ready, in.info = true, engineInfo
+	e.units["in-test"] = []*ExecUnit{in.AddExecUnit(1, nil, nil)}
+
+	// Plugins of the version 1 never acknowledge events
+	legacy := &message.PluginInfo{ProtoVer: 1}
+	start := func(name string, id int32) (*ExecUnit, *pipe.InProcess) {
+		u := NewInstance(name, e).AddExecUnit(id, nil, nil)
+		p := pipe.NewInProcess()
+		assert.NoError(t, u.Start(p, legacy))
+		for m, _ := p.Read(); m.Type != message.TypStart; m, _ = p.Read() {
+		}
+		return u, p
+	}
+	out, op := start("out-legacy", 2)
+	defer out.close()
+	filter, fp := start("filter-legacy", 3)
+	defer filter.close()
+
+	// Events written to the output are delivered
+	o := message.Origin{Unit: 1, Seq: 10}
+	ev := message.NewEvent("foo", nil)
+	ev.Origin = &o
+	e.deliver(1, o)
+	assert.NoError(t, out.Emit(ev))
+	m, _ := op.Read()
+	assert.Equal(t, message.TypEvent, m.Type)
+	m, _ = wp.Read()
+	assert.Equal(t, message.TypAck, m.Type)
+	assert.Equal(t, []message.Origin{o}, m.Payload)
+
+	// The filter doesn't pass the origin on
+	o.Seq++
+	ev = message.NewEvent("foo", nil)
+	ev.Origin = &o
+	e.deliver(1, o)
+	assert.NoError(t, filter.Emit(ev))
+	m, _ = fp.Read()
+	assert.Nil(t, m.Payload.(*message.Event).Origin)
+	m, _ = wp.Read()
+	assert.Equal(t, []message.Origin{o}, m.Payload)
+	assert.Len(t, e.flights.counts, 0)
+}
+
+func TestUnitFailed(t *testing.T) {
+	ins := NewInstance("out-test", New())
+	rp := pipe.NewInProcess()
+	ins.rp = rp
+	u := ins.AddExecUnit(1, nil, nil)
+	defer u.close()
+	assert.NoError(t, u.Start(pipe.NewInProcess(), engineInfo))
+	go ins.eventLoop(make(chan bool))
+
+	rp.Write(&message.Message{Type: message.TypUnitFailed, UnitID: 1, Payload: "broken"})
+	deadline := time.Now().Add(time.Second)
+	for !u.isFailed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, u.isFailed())
+
+	// Events are dropped until the unit is started again
+	assert.NoError(t, u.Emit(message.NewEvent("foo", nil)))
+	for atomic.LoadInt64(&u.dropped) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&u.dropped))
+	assert.NoError(t, u.Start(pipe.NewInProcess(), engineInfo))
+	assert.False(t, u.isFailed())
+}
+
+func TestWorkers(t *testing.T) {
+	plugin.EmbeddedPlugins["out-test"] = func() plugin.Plugin { return nil }
+	defer delete(plugin.EmbeddedPlugins, "out-test")
+
+	conf := &Config{Output: map[string][]map[string]interface{}{
+		"": {{"type": "test", "match": "**", "workers": int64(3), "dispatch": "key", "dispatch_key": "host"}},
+	}}
+	e := New()
+	assert.NoError(t, e.Apply(conf))
+	g, ok := e.tr[""].Route("foo").(*workerGroup)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Len(t, g.units, 3)
+	for k, key := range []string{"out-test", "out-test#1", "out-test#2"} {
+		assert.Equal(t, k, e.plugins[key].worker)
+		assert.True(t, g.units[k].ins == e.plugins[key])
+	}
+
+	ev := message.NewEvent("foo", map[string]interface{}{"host": "a"})
+	i := g.index(ev)
+	for n := 0; n < 3; n++ {
+		assert.Equal(t, i, g.index(ev))
+	}
+
+	// Workers keep their units on reload
+	assert.NoError(t, e.Apply(conf))
+	g2 := e.tr[""].Route("foo").(*workerGroup)
+	for k := range g.units {
+		assert.True(t, g.units[k] == g2.units[k])
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	info := engineInfo.Negotiate(&message.PluginInfo{
+		ProtoVer: message.ProtoVer,
+		Kind:     message.KindInput,
+		Types:    []message.MessageType{message.TypInfoRequest, message.TypConfigure, message.TypStart, message.TypStop},
+		Config:   []*message.ConfigField{{Name: "path", Type: "string"}, {Name: "ReadFromHead", Type: "bool"}},
+	})
+	assert.NoError(t, compatible("in-test", info))
+	assert.Error(t, compatible("out-test", info))
+
+	conf := map[string]interface{}{"type": "test", "path": "/tmp", "readfromhead": true, "pos": "/tmp"}
+	assert.Equal(t, []string{"pos"}, unknownKeys(info, conf))
+
+	// Older plugins describe nothing, but are compatible
+	info = engineInfo.Negotiate(&message.PluginInfo{ProtoVer: 1})
+	assert.NoError(t, compatible("out-test", info))
+	assert.Nil(t, unknownKeys(info, conf))
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+// inflight keeps events sent to a plugin process until the plugin confirms
+// that they are buffered durably, or written for memory buffers. Events not
+// confirmed are sent again to the restarted process.
+type inflight struct {
+	seq   uint64
+	list  *list.List
+	index map[uint64]*list.Element
+	limit int
+	// Signalled when events are confirmed
+	roomC chan struct{}
+	m     sync.Mutex
+}
+
+func newInflight(limit int) *inflight {
+	return &inflight{
+		list:  list.New(),
+		index: make(map[uint64]*list.Element),
+		limit: limit,
+		roomC: make(chan struct{}, 1),
+	}
+}
+
+// add assigns a sequence to the event unless replayed, then keeps it.
+func (f *inflight) add(m *message.Message) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if m.Seq == 0 {
+		f.seq++
+		m.Seq = f.seq
+	}
+	f.index[m.Seq] = f.list.PushBack(m)
+}
+
+// confirm forgets the events of the sequences.
+func (f *inflight) confirm(seqs ...uint64) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, seq := range seqs {
+		if e, ok := f.index[seq]; ok {
+			f.list.Remove(e)
+			delete(f.index, seq)
+		}
+	}
+	select {
+	case f.roomC <- struct{}{}:
+	default:
+	}
+}
+
+// take removes all events in the order sent.
+func (f *inflight) take() []*message.Message {
+	f.m.Lock()
+	defer f.m.Unlock()
+	l := make([]*message.Message, 0, f.list.Len())
+	for e := f.list.Front(); e != nil; e = e.Next() {
+		l = append(l, e.Value.(*message.Message))
+	}
+	f.list.Init()
+	f.index = make(map[uint64]*list.Element)
+	return l
+}
+
+func (f *inflight) Full() bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.list.Len() >= f.limit
+}
+
+func (f *inflight) Len() int64 {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return int64(f.list.Len())
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+)
+
+// engineInfo is sent to plugins by TypInfoRequest.
+var engineInfo = &message.PluginInfo{
+	ProtoVer: message.ProtoVer,
+	Capabilities: []string{
+		message.CapBatch,
+		message.CapAck,
+		message.CapHandoff,
+		message.CapStats,
+		message.CapPause,
+		message.CapCompress,
+		message.CapCheck,
+		message.CapFail,
+	},
+}
+
+// Keys of plugin configs handled by the engine
+var engineKeys = []string{"type", "match", "buffer", "continue", "copy_mode", "workers", "dispatch", "dispatch_key", "secondary", "id"}
+
+// kindOf returns the kind of the plugin from its name.
+func kindOf(name string) string {
+	switch {
+	case strings.HasPrefix(name, "in-"):
+		return message.KindInput
+	case strings.HasPrefix(name, "filter-"):
+		return message.KindFilter
+	}
+	return message.KindOutput
+}
+
+// compatible returns an error if the plugin can't be used as configured.
+func compatible(name string, info *message.PluginInfo) error {
+	kind := kindOf(name)
+	if info.Kind != "" && info.Kind != kind {
+		return fmt.Errorf("%s plugin is of kind %s, expected %s", name, info.Kind, kind)
+	}
+	required := []message.MessageType{message.TypInfoRequest, message.TypConfigure, message.TypStart, message.TypStop}
+	switch kind {
+	case message.KindFilter:
+		required = append(required, message.TypEvent)
+	case message.KindOutput:
+		required = append(required, message.TypBufferOption, message.TypEvent)
+	}
+	for _, typ := range required {
+		if !info.Accepts(typ) {
+			return fmt.Errorf("%s plugin doesn't handle message type %d", name, typ)
+		}
+	}
+	return nil
+}
+
+// unknownKeys returns keys of the config not described by the plugin, nil if
+// the plugin doesn't describe its config.
+func unknownKeys(info *message.PluginInfo, conf map[string]interface{}) []string {
+	if info.Config == nil {
+		return nil
+	}
+	var keys []string
+	for key := range conf {
+		if !knownKey(info, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func knownKey(info *message.PluginInfo, key string) bool {
+	for _, k := range engineKeys {
+		if k == key {
+			return true
+		}
+	}
+	// Keys are matched case-insensitively as toml does
+	for _, f := range info.Config {
+		if strings.EqualFold(f.Name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiated applies the info of the plugin, or returns an error if it's not
+// compatible.
+func (i *Instance) negotiated(info *message.PluginInfo) error {
+	// The plugin has switched already, even if it's refused
+	for _, p := range []pipe.Pipe{i.rp, i.wp} {
+		if p, ok := p.(*pipe.InterProcess); ok {
+			p.SetVersion(info.ProtoVer)
+		}
+	}
+	if err := compatible(i.name, info); err != nil {
+		return err
+	}
+	i.eng.log.Infof("%s plugin: protocol version %d", i.name, info.ProtoVer)
+
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.info = info
+	for _, u := range i.units {
+		if keys := unknownKeys(info, u.conf); len(keys) > 0 {
+			i.eng.log.Warningf("%s plugin: unknown config keys: %s", i.name, strings.Join(keys, ", "))
+		}
+		if u.bopts != nil && u.bopts.Compress != buffer.CompressNone && !info.Has(message.CapCompress) {
+			i.eng.log.Warningf("%s plugin doesn't compress chunks", i.name)
+		}
+	}
+	return nil
+}
+
+// supports reports whether the running plugin supports the capability.
+func (i *Instance) supports(cap string) bool {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return i.ready && i.info.Has(cap)
+}
+
+// refuse stops the plugin not compatible. The process is not restarted until
+// reload. Embedded plugins never become compatible, so they are just stopped
+// instead of failed.
+func (e *Engine) refuse(ins *Instance, err error) {
+	e.log.Criticalf("Refused %s plugin: %v", ins.name, err)
+	if ins.proc != nil {
+		ins.m.Lock()
+		ins.failed = true
+		ins.m.Unlock()
+		ins.wakeUnits()
+		ins.proc.Stop()
+	}
+	ins.wp.Write(&message.Message{Type: message.TypStop})
+}
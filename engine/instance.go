@@ -3,10 +3,15 @@ package engine
 import (
 	"bytes"
 	"container/list"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/yosisa/fluxion/buffer"
@@ -15,88 +20,368 @@ import (
 )
 
 type Instance struct {
-	name  string
-	eng   *Engine
-	dec   message.Decoder
-	units map[int32]*ExecUnit
-	rp    pipe.Pipe
-	wp    pipe.Pipe
-	doneC chan bool
+	name     string
+	key      string
+	worker   int
+	eng      *Engine
+	dec      message.Decoder
+	units    map[int32]*ExecUnit
+	rp       pipe.Pipe
+	wp       pipe.Pipe
+	embedded bool
+	ready    bool
+	failed   bool
+	starts   int
+	crashes  int
+	doneC    chan bool
+	statsC   chan *message.Stats
+	statsM   sync.Mutex
+	m        sync.Mutex
+	// Supervisor of the plugin process, nil if embedded
+	proc *process
+	// Interrupts the embedded plugin before stopping
+	interrupt func()
+	// Messages skipped since not decodable
+	protocolErrors int
+	// Negotiated with the running plugin
+	info *message.PluginInfo
 }
 
 func NewInstance(name string, eng *Engine) *Instance {
 	return &Instance{
-		name:  name,
-		eng:   eng,
-		units: make(map[int32]*ExecUnit),
-		doneC: make(chan bool),
+		name:   name,
+		key:    name,
+		eng:    eng,
+		units:  make(map[int32]*ExecUnit),
+		doneC:  make(chan bool),
+		statsC: make(chan *message.Stats, 1),
 	}
 }
 
 func (i *Instance) AddExecUnit(id int32, conf map[string]interface{}, bopts *buffer.Options) *ExecUnit {
-	i.units[id] = newExecUnit(id, conf, bopts)
-	return i.units[id]
+	i.m.Lock()
+	defer i.m.Unlock()
+	u := newExecUnit(id, conf, bopts)
+	u.ins = i
+	if !i.embedded {
+		// Embedded plugins don't restart alone
+		u.inflight = newInflight(pendingLimit)
+	}
+	i.units[id] = u
+	return u
+}
+
+// StartExecUnit starts the unit added after the plugin is started. Otherwise
+// the unit is started along with the plugin.
+func (i *Instance) StartExecUnit(u *ExecUnit) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if !i.ready || u.currentTerm() > 0 {
+		return nil
+	}
+	return u.Start(i.wp, i.info)
+}
+
+// RemoveExecUnit stops the unit. Output units flush their buffer in the
+// background.
+func (i *Instance) RemoveExecUnit(u *ExecUnit) {
+	i.m.Lock()
+	delete(i.units, u.ID)
+	if i.ready && i.info.Accepts(message.TypStopUnit) {
+		u.Send(&message.Message{Type: message.TypStopUnit})
+	}
+	u.close()
+	i.m.Unlock()
+	i.eng.resume(u)
+}
+
+// protocolError records a message skipped by the engine or the plugin. The
+// plugin is restarted if needed to recover.
+func (i *Instance) protocolError(typ message.MessageType, s string, restart bool) {
+	i.m.Lock()
+	i.protocolErrors++
+	i.m.Unlock()
+	if !restart || i.proc == nil {
+		i.eng.log.Warningf("%s plugin: skipped message of type %d: %s", i.name, typ, s)
+		return
+	}
+	i.eng.log.Errorf("%s plugin: skipped message of type %d: %s, restarting", i.name, typ, s)
+	i.proc.Kill()
+}
+
+// emit passes the event emitted by the plugin to the engine.
+func (i *Instance) emit(ev *message.Event) {
+	if ev.Origin != nil {
+		i.eng.deliver(1, *ev.Origin)
+	}
+	i.eng.Filter(ev)
+}
+
+func (i *Instance) isFailed() bool {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return i.failed
+}
+
+// wakeUnits makes the units notice that the plugin is failed.
+func (i *Instance) wakeUnits() {
+	i.m.Lock()
+	defer i.m.Unlock()
+	for _, u := range i.units {
+		select {
+		case u.startC <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (i *Instance) isInput() bool {
+	return strings.HasPrefix(i.name, "in-")
+}
+
+func (i *Instance) isFilter() bool {
+	return strings.HasPrefix(i.name, "filter-")
+}
+
+func (i *Instance) unit(id int32) (*ExecUnit, bool) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	u, ok := i.units[id]
+	return u, ok
 }
 
 func (i *Instance) Start() {
-	i.wp.Write(&message.Message{Type: message.TypInfoRequest})
-	go i.eventLoop()
+	i.m.Lock()
+	i.ready = false
+	i.starts++
+	// The refused process has terminated before restarted
+	select {
+	case <-i.doneC:
+		i.doneC = make(chan bool)
+	default:
+	}
+	doneC := i.doneC
+	units := make([]*ExecUnit, 0, len(i.units))
+	for _, u := range i.units {
+		units = append(units, u)
+	}
+	i.m.Unlock()
+	// Pauses requested by the previous process are no longer valid
+	for _, u := range units {
+		i.eng.resume(u)
+	}
+	i.wp.Write(&message.Message{Type: message.TypInfoRequest, Payload: engineInfo})
+	go i.eventLoop(doneC)
 }
 
 func (i *Instance) Stop() {
+	var exited <-chan struct{}
+	// Full buffers would block the plugin from reading the stop message
+	if i.proc != nil {
+		exited = i.proc.Done()
+		i.proc.Interrupt()
+	} else if i.interrupt != nil {
+		i.interrupt()
+	}
 	i.wp.Write(&message.Message{Type: message.TypStop})
-	<-i.doneC
+	i.m.Lock()
+	doneC := i.doneC
+	i.m.Unlock()
+	// The process may be killed, or be failed already
+	select {
+	case <-doneC:
+	case <-exited:
+	}
 }
 
-func (i *Instance) eventLoop() {
+// Stats requests the plugin to report the stats of its units. It returns nil
+// if the plugin doesn't respond in time.
+func (i *Instance) Stats(timeout time.Duration) *message.Stats {
+	i.statsM.Lock()
+	defer i.statsM.Unlock()
+	if !i.supports(message.CapStats) {
+		return nil
+	}
+
+	// Discard the response to the previous request timed out
+	select {
+	case <-i.statsC:
+	default:
+	}
+	// The pipe may be blocked when the plugin is busy
+	go i.wp.Write(&message.Message{Type: message.TypStatsRequest})
+	select {
+	case stats := <-i.statsC:
+		return stats
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func (i *Instance) eventLoop(doneC chan bool) {
 	for {
 		m, err := i.rp.Read()
+		if ferr, ok := err.(*pipe.FrameError); ok {
+			i.protocolError(ferr.Type, ferr.Err.Error(), false)
+			continue
+		}
 		if err != nil {
+			if err == pipe.ErrCorrupted && i.proc != nil {
+				i.eng.log.Criticalf("%s plugin: %v, restarting", i.name, err)
+				i.proc.Kill()
+			}
 			return
 		}
 
 		switch m.Type {
+		case message.TypUnitFailed:
+			if unit, ok := i.unit(m.UnitID); ok {
+				unit.fail(m.Payload.(string))
+			}
+		case message.TypProtocolError:
+			perr := m.Payload.(*message.ProtocolError)
+			// Events are replayed only to a new process
+			lost := perr.Type == message.TypEvent || perr.Type == message.TypEventBatch
+			i.protocolError(perr.Type, perr.Error, lost)
 		case message.TypInfoResponse:
-			info := m.Payload.(*message.PluginInfo)
-			i.eng.log.Infof("%s plugin: protocol version %d", i.name, info.ProtoVer)
+			info := engineInfo.Negotiate(m.Payload.(*message.PluginInfo))
+			if err := i.negotiated(info); err != nil {
+				i.eng.refuse(i, err)
+				continue
+			}
+			i.m.Lock()
+			i.ready = true
 			for _, u := range i.units {
-				u.pipe = i.wp
-				u.Start()
+				u.Start(i.wp, info)
+			}
+			i.m.Unlock()
+			if i.isInput() && i.eng.paused() && info.Has(message.CapPause) {
+				i.wp.Write(&message.Message{Type: message.TypPause})
 			}
 		case message.TypEvent:
-			i.eng.Filter(m.Payload.(*message.Event))
+			i.emit(m.Payload.(*message.Event))
 		case message.TypEventChain:
-			unit, ok := i.units[m.UnitID]
+			unit, ok := i.unit(m.UnitID)
+			if !ok {
+				log.Printf("Unit ID %d not known", m.UnitID)
+				continue
+			}
+			i.eng.emitChain(unit, m.Payload.(*message.Event))
+		case message.TypEventBatch:
+			batch := m.Payload.(*message.EventBatch)
+			if !batch.Chain {
+				for _, ev := range batch.Events {
+					i.emit(ev)
+				}
+				continue
+			}
+			unit, ok := i.unit(m.UnitID)
+			if !ok {
+				log.Printf("Unit ID %d not known", m.UnitID)
+				continue
+			}
+			for _, ev := range batch.Events {
+				i.eng.emitChain(unit, ev)
+			}
+		case message.TypEventSecondary:
+			unit, ok := i.unit(m.UnitID)
 			if !ok {
 				log.Printf("Unit ID %d not known", m.UnitID)
 				continue
 			}
-
 			ev := m.Payload.(*message.Event)
-			if e := unit.Router.Route(ev.Tag); e != nil {
-				e.Emit(ev)
+			if s := i.eng.secondary(unit); s == nil || s.Emit(ev) != nil {
+				i.eng.delivered(ev)
+			}
+		case message.TypAck:
+			i.eng.deliver(-1, m.Payload.([]message.Origin)...)
+		case message.TypHandoff:
+			if unit, ok := i.unit(m.UnitID); ok && unit.inflight != nil {
+				unit.inflight.confirm(m.Payload.([]uint64)...)
+			}
+		case message.TypPause, message.TypResume:
+			unit, ok := i.unit(m.UnitID)
+			if !ok {
+				continue
+			}
+			if m.Type == message.TypPause {
+				i.eng.pause(unit)
 			} else {
-				i.eng.Emit(ev)
+				i.eng.resume(unit)
+			}
+		case message.TypStats:
+			select {
+			case i.statsC <- m.Payload.(*message.Stats):
+			default:
 			}
 		case message.TypStdout:
 			fmt.Printf("%s", m.Payload.([]byte))
 		case message.TypTerminated:
-			close(i.doneC)
+			close(doneC)
 			return
 		}
 	}
 }
 
+// CopyMode specifies how an event is copied before emitted to the unit. By
+// default, the event is deeply copied only if it's emitted to multiple units.
+type CopyMode int
+
+const (
+	CopyDefault CopyMode = iota
+	CopyNone
+	CopyShallow
+	CopyDeep
+)
+
+func (m *CopyMode) UnmarshalText(b []byte) (err error) {
+	switch string(b) {
+	case "":
+		*m = CopyDefault
+	case "no_copy":
+		*m = CopyNone
+	case "shallow":
+		*m = CopyShallow
+	case "deep":
+		*m = CopyDeep
+	default:
+		err = errors.New("copy_mode must be no_copy, shallow or deep")
+	}
+	return
+}
+
+// Limit of events kept by a unit while the plugin is not available, or not
+// confirmed by the plugin.
+const pendingLimit = 100 * 1024
+
 type ExecUnit struct {
-	ID      int32
-	Router  *TagRouter
-	enc     message.Encoder
-	conf    map[string]interface{}
-	bopts   *buffer.Options
-	pipe    pipe.Pipe
-	pending *pending
-	term    int
-	emitC   chan *message.Message
+	ID        int32
+	Router    *TagRouter
+	Secondary *ExecUnit
+	CopyMode  CopyMode
+	ins       *Instance
+	enc       message.Encoder
+	conf      map[string]interface{}
+	bopts     *buffer.Options
+	limit     buffer.HumanSize
+	pipe      pipe.Pipe
+	peer      *message.PluginInfo
+	pending   *pending
+	inflight  *inflight
+	term      int
+	emitC     chan *message.Message
+	// Notified when the plugin is started or failed
+	startC chan struct{}
+	quit   chan struct{}
+	// Events dropped while the plugin is unavailable, accessed atomically
+	dropped int64
+	// Whether dropping is logged since the plugin became unavailable
+	dropping bool
+	// Set if the unit failed to be configured or started
+	failed bool
+	// Guards pipe, peer, term and failed, which are changed when the plugin
+	// restarts
+	m sync.Mutex
 }
 
 func newExecUnit(id int32, conf map[string]interface{}, bopts *buffer.Options) *ExecUnit {
@@ -105,15 +390,28 @@ func newExecUnit(id int32, conf map[string]interface{}, bopts *buffer.Options) *
 		Router:  &TagRouter{},
 		conf:    conf,
 		bopts:   bopts,
-		pending: newPending(100 * 1024),
+		pending: newPending(pendingLimit),
 		emitC:   make(chan *message.Message),
+		startC:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
 	}
 	go u.pendingLoop()
 	return u
 }
 
-func (u *ExecUnit) Start() error {
-	if err := u.Send(&message.Message{Type: message.TypBufferOption, Payload: u.bopts}); err != nil {
+// Start starts the unit with the pipe to the plugin process.
+func (u *ExecUnit) Start(p pipe.Pipe, peer *message.PluginInfo) error {
+	u.m.Lock()
+	u.pipe, u.peer = p, peer
+	u.m.Unlock()
+
+	bopts := u.bopts
+	if bopts != nil && u.limit > 0 {
+		opts := *bopts
+		opts.GlobalLimitSize = u.limit
+		bopts = &opts
+	}
+	if err := u.Send(&message.Message{Type: message.TypBufferOption, Payload: bopts}); err != nil {
 		return err
 	}
 	if err := u.Send(&message.Message{Type: message.TypConfigure, Payload: encodeConf(u.conf)}); err != nil {
@@ -123,44 +421,223 @@ func (u *ExecUnit) Start() error {
 		return err
 	}
 
+	u.m.Lock()
 	u.term++
+	u.failed = false
+	u.m.Unlock()
+	select {
+	case u.startC <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
+// fail marks the unit failed as reported by the plugin. Events are dropped
+// until the plugin is restarted.
+func (u *ExecUnit) fail(s string) {
+	u.ins.eng.log.Criticalf("Unit %d of %s plugin failed: %s", u.ID, u.ins.name, s)
+	u.m.Lock()
+	u.failed = true
+	u.m.Unlock()
+	select {
+	case u.startC <- struct{}{}:
+	default:
+	}
+}
+
+// isFailed reports whether the unit or the plugin is failed.
+func (u *ExecUnit) isFailed() bool {
+	u.m.Lock()
+	failed := u.failed
+	u.m.Unlock()
+	return failed || u.ins.isFailed()
+}
+
 func (u *ExecUnit) Emit(ev *message.Event) error {
-	u.emitC <- &message.Message{Type: message.TypEvent, Payload: ev}
+	select {
+	case u.emitC <- &message.Message{Type: message.TypEvent, Payload: ev}:
+	case <-u.quit:
+		return errUnitClosed
+	}
 	return nil
 }
 
+// currentTerm returns how many times the unit has been started.
+func (u *ExecUnit) currentTerm() int {
+	u.m.Lock()
+	defer u.m.Unlock()
+	return u.term
+}
+
+// close stops emitting events to the unit.
+func (u *ExecUnit) close() {
+	close(u.quit)
+}
+
 func (u *ExecUnit) pendingLoop() {
-	term := u.term
+	// Not started yet, the loop may run after Start
+	var term int
 	for {
-		curTerm := u.term
+		curTerm := u.currentTerm()
 		if curTerm > term {
 			term = curTerm
+			if u.inflight != nil {
+				// Events lost by the previous process are sent again
+				u.pending.Requeue(u.inflight.take())
+			}
 			err := u.pending.Flush(u.sendPending)
 			if err == nil {
-				u.emitLoop()
+				u.dropping = false
+				u.emitLoop(term)
 				continue
 			}
 		}
 
-		ev := <-u.emitC
-		u.pending.Add(ev)
+		// Emitters are never blocked here, since the plugin may not come
+		// back and the emitters feed other units as well
+		select {
+		case ev := <-u.emitC:
+			if u.isFailed() {
+				// Not available until restarted
+				u.drop(ev)
+				continue
+			}
+			if u.pending.Full() {
+				u.drop(u.pending.Shift().(*message.Message))
+			}
+			u.pending.Add(ev)
+		case <-u.startC:
+		case <-u.quit:
+			return
+		}
 	}
 }
 
-func (u *ExecUnit) emitLoop() {
+// emitLoop sends events to the plugin. Events are coalesced into batches
+// within the limits of message.BatchSize and message.BatchDelay.
+func (u *ExecUnit) emitLoop(term int) {
+	var batch []*message.Message
+	var timeout <-chan time.Time
 	for {
-		ev := <-u.emitC
-		err := u.Send(ev)
-		if err == nil {
+		// Emitters are blocked while too many events are not confirmed
+		emitC := u.emitC
+		var roomC chan struct{}
+		if u.inflight != nil && u.inflight.Full() {
+			emitC, roomC = nil, u.inflight.roomC
+		}
+		select {
+		case ev := <-emitC:
+			batch = append(batch, ev)
+			if len(batch) == 1 {
+				timeout = time.After(message.BatchDelay)
+			}
+			if len(batch) < message.BatchSize {
+				continue
+			}
+		case <-timeout:
+		case <-roomC:
+			continue
+		case <-u.startC:
+			if u.currentTerm() != term || u.isFailed() {
+				// Restarted while idle, unconfirmed events must be replayed
+				for _, ev := range batch {
+					u.pending.Add(ev)
+				}
+				return
+			}
 			continue
+		case <-u.quit:
+			// The unit is removed, the events are never written
+			for _, ev := range batch {
+				u.ins.eng.delivered(ev.Payload.(*message.Event))
+			}
+			return
+		}
+		if err := u.sendBatch(batch); err != nil {
+			return
 		}
+		batch, timeout = nil, nil
+	}
+}
 
-		u.pending.Add(ev)
-		return
+// sendBatch sends the events in a TypEventBatch, or one by one if the plugin
+// doesn't support batches. Events not sent are added to the pending.
+func (u *ExecUnit) sendBatch(l []*message.Message) error {
+	u.m.Lock()
+	peer := u.peer
+	u.m.Unlock()
+	if len(l) == 1 || !peer.Has(message.CapBatch) {
+		for i, m := range l {
+			if err := u.Send(m); err != nil {
+				for _, m := range l[i:] {
+					u.pending.Add(m)
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	batch := &message.EventBatch{Events: make([]*message.Event, len(l))}
+	for i, m := range l {
+		batch.Events[i] = m.Payload.(*message.Event)
+	}
+	var origins []message.Origin
+	if !peer.Has(message.CapAck) {
+		origins = u.unacked(batch.Events...)
+	}
+	handoff := u.inflight != nil && peer.Has(message.CapHandoff)
+	if handoff {
+		// Kept before writing, since the plugin may confirm them immediately
+		batch.Seqs = make([]uint64, len(l))
+		for i, m := range l {
+			u.inflight.add(m)
+			batch.Seqs[i] = m.Seq
+		}
+	}
+	err := u.Send(&message.Message{Type: message.TypEventBatch, Payload: batch})
+	if err != nil {
+		if handoff {
+			u.inflight.confirm(batch.Seqs...)
+		}
+		for _, m := range l {
+			u.pending.Add(m)
+		}
+	} else if len(origins) > 0 {
+		u.ins.eng.deliver(-1, origins...)
+	}
+	return err
+}
+
+// unacked returns the origins of the events sent to the plugin not
+// supporting acks, which are delivered once written. Filters don't pass the
+// origins on either, so they are delivered and cleared before writing.
+func (u *ExecUnit) unacked(evs ...*message.Event) []message.Origin {
+	var origins []message.Origin
+	for _, ev := range evs {
+		if ev.Origin != nil {
+			origins = append(origins, *ev.Origin)
+		}
+	}
+	if len(origins) == 0 || !u.ins.isFilter() {
+		return origins
+	}
+	for _, ev := range evs {
+		ev.Origin = nil
+	}
+	u.ins.eng.deliver(-1, origins...)
+	return nil
+}
+
+// drop discards the event, which is never written since the plugin is
+// unavailable.
+func (u *ExecUnit) drop(m *message.Message) {
+	atomic.AddInt64(&u.dropped, 1)
+	if !u.dropping {
+		u.dropping = true
+		u.ins.eng.log.Warningf("Unit %d of %s plugin is unavailable, dropping events", u.ID, u.ins.name)
 	}
+	u.ins.eng.delivered(m.Payload.(*message.Event))
 }
 
 func (u *ExecUnit) sendPending(v interface{}) error {
@@ -169,12 +646,34 @@ func (u *ExecUnit) sendPending(v interface{}) error {
 
 func (u *ExecUnit) Send(ev *message.Message) (err error) {
 	ev.UnitID = u.ID
-	return u.pipe.Write(ev)
+	u.m.Lock()
+	p, peer := u.pipe, u.peer
+	u.m.Unlock()
+	// Kept before writing, since the plugin may confirm it immediately
+	track := ev.Type == message.TypEvent && u.inflight != nil && peer.Has(message.CapHandoff)
+	if track {
+		u.inflight.add(ev)
+	}
+	var origins []message.Origin
+	if ev.Type == message.TypEvent && !peer.Has(message.CapAck) {
+		origins = u.unacked(ev.Payload.(*message.Event))
+	}
+	if err = p.Write(ev); err != nil {
+		if track {
+			// It goes back to the pending
+			u.inflight.confirm(ev.Seq)
+		}
+	} else if len(origins) > 0 {
+		u.ins.eng.deliver(-1, origins...)
+	}
+	return
 }
 
 type pending struct {
 	list  *list.List
 	limit int
+	// Length of the list, accessed atomically
+	size int64
 }
 
 func newPending(limit int) *pending {
@@ -185,11 +684,33 @@ func newPending(limit int) *pending {
 }
 
 func (p *pending) Add(v interface{}) {
-	// trim the pending if limit exceeded
-	for i := p.list.Len() - p.limit; i >= 0; i-- {
-		p.list.Remove(p.list.Front())
-	}
 	p.list.PushBack(v)
+	atomic.StoreInt64(&p.size, int64(p.list.Len()))
+}
+
+// Requeue puts the events before the pending ones.
+func (p *pending) Requeue(l []*message.Message) {
+	for i := len(l) - 1; i >= 0; i-- {
+		p.list.PushFront(l[i])
+	}
+	atomic.StoreInt64(&p.size, int64(p.list.Len()))
+}
+
+// Shift removes the oldest event and returns it.
+func (p *pending) Shift() interface{} {
+	v := p.list.Remove(p.list.Front())
+	atomic.StoreInt64(&p.size, int64(p.list.Len()))
+	return v
+}
+
+func (p *pending) Full() bool {
+	return p.list.Len() >= p.limit
+}
+
+// Len returns the number of pending events. It's safe to call from other
+// goroutines.
+func (p *pending) Len() int64 {
+	return atomic.LoadInt64(&p.size)
 }
 
 func (p *pending) Flush(f func(interface{}) error) error {
@@ -198,6 +719,7 @@ func (p *pending) Flush(f func(interface{}) error) error {
 			return err
 		}
 		p.list.Remove(e)
+		atomic.StoreInt64(&p.size, int64(p.list.Len()))
 	}
 	return nil
 }
@@ -207,8 +729,15 @@ func prepareFuncFactory(i *Instance) func(*exec.Cmd) {
 		cmd.Stderr = os.Stderr
 		w, _ := cmd.StdinPipe()
 		r, _ := cmd.StdoutPipe()
-		i.rp = pipe.NewInterProcess(r, nil)
-		i.wp = pipe.NewInterProcess(nil, w)
+		wp := pipe.NewInterProcess(nil, w)
+		if wp.Checksum = atomic.LoadInt32(&i.eng.checksum) != 0; wp.Checksum {
+			cmd.Env = append(os.Environ(), pipe.ChecksumEnv+"=1")
+		}
+		rp := pipe.NewInterProcess(r, nil)
+		// The oldest version is used until negotiated
+		rp.SetVersion(message.MinProtoVer)
+		wp.SetVersion(message.MinProtoVer)
+		i.rp, i.wp = rp, wp
 		i.Start()
 	}
 }
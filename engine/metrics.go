@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yosisa/fluxion/buffer"
+)
+
+type sample struct {
+	suffix string
+	labels []string
+	value  float64
+}
+
+type family struct {
+	name    string
+	typ     string
+	help    string
+	samples []*sample
+}
+
+// metrics builds metrics in the Prometheus text format. Samples are grouped
+// by family in the order of the first appearance.
+type metrics struct {
+	families []*family
+	index    map[string]*family
+}
+
+func newMetrics() *metrics {
+	return &metrics{index: make(map[string]*family)}
+}
+
+func (m *metrics) family(name, typ, help string) *family {
+	name = "fluxion_" + name
+	f, ok := m.index[name]
+	if !ok {
+		f = &family{name: name, typ: typ, help: help}
+		m.families = append(m.families, f)
+		m.index[name] = f
+	}
+	return f
+}
+
+// add adds a sample. labels is a list of label names and values.
+func (m *metrics) add(name, typ, help string, v float64, labels ...string) {
+	f := m.family(name, typ, help)
+	f.samples = append(f.samples, &sample{labels: labels, value: v})
+}
+
+func (m *metrics) gauge(name, help string, v float64, labels ...string) {
+	m.add(name, "gauge", help, v, labels...)
+}
+
+func (m *metrics) counter(name, help string, v float64, labels ...string) {
+	m.add(name, "counter", help, v, labels...)
+}
+
+func (m *metrics) histogram(name, help string, h *buffer.Histogram, labels ...string) {
+	f := m.family(name, "histogram", help)
+	var n int64
+	for i, bound := range h.Bounds {
+		n += h.Counts[i]
+		le := append(labels[:len(labels):len(labels)], "le", formatFloat(bound))
+		f.samples = append(f.samples, &sample{"_bucket", le, float64(n)})
+	}
+	n += h.Counts[len(h.Bounds)]
+	le := append(labels[:len(labels):len(labels)], "le", "+Inf")
+	f.samples = append(f.samples,
+		&sample{"_bucket", le, float64(n)},
+		&sample{"_sum", labels, h.Sum},
+		&sample{"_count", labels, float64(n)})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metrics) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range m.families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.samples {
+			bw.WriteString(f.name + s.suffix)
+			if len(s.labels) > 0 {
+				bw.WriteByte('{')
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, `%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteString(" " + formatFloat(s.value) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// collect converts the state of all plugin instances into metrics.
+func (e *Engine) collect() *metrics {
+	m := newMetrics()
+	for _, st := range e.status() {
+		var up float64
+		if st.State == "running" {
+			up = 1
+		}
+		worker := strconv.Itoa(st.Worker)
+		m.gauge("plugin_up", "Whether the plugin is running.", up, "plugin", st.Name, "worker", worker)
+		m.counter("plugin_restarts_total", "Number of plugin process crashes.", float64(st.Crashes), "plugin", st.Name, "worker", worker)
+		m.counter("protocol_errors_total", "Messages skipped since not decodable.", float64(st.ProtocolErrors), "plugin", st.Name, "worker", worker)
+
+		for _, us := range st.Units {
+			labels := []string{"plugin", st.Name, "unit", strconv.Itoa(int(us.ID))}
+			m.gauge("pending_events", "Events waiting in the engine for the plugin.", float64(us.Pending), labels...)
+			m.gauge("inflight_events", "Events sent to the plugin but not confirmed.", float64(us.Inflight), labels...)
+			m.counter("dropped_events_total", "Events dropped while the plugin is unavailable.", float64(us.Dropped), labels...)
+			if us.Stats != nil {
+				collectUnit(m, us, labels)
+			}
+		}
+	}
+	return m
+}
+
+func collectUnit(m *metrics, us *unitStatus, labels []string) {
+	s := us.Stats
+	with := func(kv ...string) []string {
+		return append(labels[:len(labels):len(labels)], kv...)
+	}
+	for _, tag := range sortedKeys(s.EventsIn) {
+		m.counter("events_in_total", "Events received by the unit by tag prefix.", float64(s.EventsIn[tag]), with("tag", tag)...)
+	}
+	for _, tag := range sortedKeys(s.EventsOut) {
+		m.counter("events_out_total", "Events emitted by the unit by tag prefix.", float64(s.EventsOut[tag]), with("tag", tag)...)
+	}
+	m.counter("items_written_total", "Items written by the output.", float64(s.Written), labels...)
+	m.counter("filter_errors_total", "Errors returned by Filter.", float64(s.FilterErrors), labels...)
+	m.counter("encode_errors_total", "Errors returned by Encode.", float64(s.EncodeErrors), labels...)
+
+	if b := s.Buffer; b != nil {
+		m.gauge("buffer_bytes", "Bytes held in the buffer.", float64(b.TotalSize), labels...)
+		m.gauge("buffer_limit_bytes", "Size limit of the buffer, 0 if unlimited.", float64(b.LimitSize), labels...)
+		m.gauge("buffer_queued_chunks", "Chunks queued to be written.", float64(b.QueuedChunks), labels...)
+		m.gauge("buffer_staged_chunks", "Chunks being filled.", float64(b.StagedChunks), labels...)
+		m.counter("buffer_retries_total", "Failed writes of chunks.", float64(b.Retries), labels...)
+		m.counter("buffer_dropped_total", "Items dropped by overflow or retry limit.", float64(b.Dropped), labels...)
+		if b.FlushLatency != nil {
+			m.histogram("flush_duration_seconds", "Time taken to write a chunk.", b.FlushLatency, labels...)
+		}
+	}
+
+	for _, metric := range s.Metrics {
+		kv := with()
+		for _, k := range sortedLabels(metric.Labels) {
+			kv = append(kv, k, metric.Labels[k])
+		}
+		m.gauge(metric.Name, metric.Help, metric.Value, kv...)
+	}
+}
+
+func sortedKeys(counts map[string]int64) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedLabels(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *Engine) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := e.collect().write(w); err != nil {
+		e.log.Warning("Monitor error: ", err)
+	}
+}
@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.counter("events_in_total", "Events.", 3, "plugin", "out-file", "tag", `a"b`)
+	m.gauge("plugin_up", "Up.", 1, "plugin", "out-file")
+	m.counter("events_in_total", "Events.", 1, "plugin", "out-file", "tag", "c")
+	m.histogram("flush_duration_seconds", "Latency.", &buffer.Histogram{
+		Bounds: []float64{0.1, 1},
+		Counts: []int64{2, 1, 1},
+		Sum:    3.5,
+	}, "unit", "1")
+
+	b := new(bytes.Buffer)
+	assert.NoError(t, m.write(b))
+	assert.Equal(t, `# HELP fluxion_events_in_total Events.
+# TYPE fluxion_events_in_total counter
+fluxion_events_in_total{plugin="out-file",tag="a\"b"} 3
+fluxion_events_in_total{plugin="out-file",tag="c"} 1
+# HELP fluxion_plugin_up Up.
+# TYPE fluxion_plugin_up gauge
+fluxion_plugin_up{plugin="out-file"} 1
+# HELP fluxion_flush_duration_seconds Latency.
+# TYPE fluxion_flush_duration_seconds histogram
+fluxion_flush_duration_seconds_bucket{unit="1",le="0.1"} 2
+fluxion_flush_duration_seconds_bucket{unit="1",le="1"} 3
+fluxion_flush_duration_seconds_bucket{unit="1",le="+Inf"} 4
+fluxion_flush_duration_seconds_sum{unit="1"} 3.5
+fluxion_flush_duration_seconds_count{unit="1"} 4
+`, b.String())
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ugorji/go/codec"
+	"github.com/yosisa/fluxion/message"
+)
+
+// statsTimeout is the time to wait for the stats of all the plugins.
+var statsTimeout = 3 * time.Second
+
+var jh = &codec.JsonHandle{}
+
+type instanceStatus struct {
+	Name     string        `codec:"name"`
+	Worker   int           `codec:"worker"`
+	Embedded bool          `codec:"embedded"`
+	State    string        `codec:"state"`
+	Starts   int           `codec:"starts"`
+	Crashes  int           `codec:"crashes"`
+	Units    []*unitStatus `codec:"units"`
+	// Messages skipped since not decodable
+	ProtocolErrors int `codec:"protocol_errors"`
+}
+
+type unitStatus struct {
+	ID     int32                  `codec:"id"`
+	Config map[string]interface{} `codec:"config"`
+	// Events waiting in the engine until the plugin becomes available
+	Pending int64 `codec:"pending"`
+	// Events sent to the plugin, but not confirmed to be buffered durably
+	Inflight int64 `codec:"inflight"`
+	// Events dropped while the plugin is unavailable
+	Dropped int64 `codec:"dropped"`
+	// Set if the unit failed to be configured or started
+	Failed    bool               `codec:"failed,omitempty"`
+	Secondary int32              `codec:"secondary,omitempty"`
+	Stats     *message.UnitStats `codec:"stats"`
+}
+
+// status returns the state of the instance and its units. The stats are nil
+// if the plugin is not running or doesn't respond by the deadline.
+func (i *Instance) status(deadline time.Time) *instanceStatus {
+	stats := make(map[int32]*message.UnitStats)
+	if s := i.Stats(deadline.Sub(time.Now())); s != nil {
+		for _, us := range s.Units {
+			stats[us.ID] = us
+		}
+	}
+
+	i.m.Lock()
+	defer i.m.Unlock()
+	st := &instanceStatus{
+		Name:           i.name,
+		Worker:         i.worker,
+		Embedded:       i.embedded,
+		State:          "starting",
+		Starts:         i.starts,
+		Crashes:        i.crashes,
+		ProtocolErrors: i.protocolErrors,
+		Units:          []*unitStatus{},
+	}
+	select {
+	case <-i.doneC:
+		st.State = "stopped"
+	default:
+		if i.failed {
+			st.State = "failed"
+		} else if i.ready {
+			st.State = "running"
+		}
+	}
+	for id, u := range i.units {
+		us := &unitStatus{
+			ID:      id,
+			Config:  u.conf,
+			Pending: u.pending.Len(),
+			Dropped: atomic.LoadInt64(&u.dropped),
+			Stats:   stats[id],
+		}
+		u.m.Lock()
+		us.Failed = u.failed
+		u.m.Unlock()
+		if u.inflight != nil {
+			us.Inflight = u.inflight.Len()
+		}
+		st.Units = append(st.Units, us)
+	}
+	sort.Sort(unitsByID(st.Units))
+	return st
+}
+
+type unitsByID []*unitStatus
+
+func (s unitsByID) Len() int           { return len(s) }
+func (s unitsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s unitsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type instancesByName []*Instance
+
+func (s instancesByName) Len() int      { return len(s) }
+func (s instancesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s instancesByName) Less(i, j int) bool {
+	if s[i].name != s[j].name {
+		return s[i].name < s[j].name
+	}
+	return s[i].worker < s[j].worker
+}
+
+// status returns the state of all plugin instances sorted by name and worker.
+func (e *Engine) status() []*instanceStatus {
+	e.rm.RLock()
+	plugins := make([]*Instance, 0, len(e.plugins))
+	for _, ins := range e.plugins {
+		plugins = append(plugins, ins)
+	}
+	secondaries := make(map[int32]int32)
+	for _, units := range e.units {
+		for _, u := range units {
+			if u.Secondary != nil {
+				secondaries[u.ID] = u.Secondary.ID
+			}
+		}
+	}
+	e.rm.RUnlock()
+
+	sort.Sort(instancesByName(plugins))
+	sts := make([]*instanceStatus, len(plugins))
+	// Plugins are queried at once, so that a busy one doesn't delay others
+	deadline := time.Now().Add(statsTimeout)
+	var wg sync.WaitGroup
+	for i, ins := range plugins {
+		wg.Add(1)
+		go func(i int, ins *Instance) {
+			defer wg.Done()
+			sts[i] = ins.status(deadline)
+		}(i, ins)
+	}
+	wg.Wait()
+	for _, st := range sts {
+		for _, us := range st.Units {
+			us.Secondary = secondaries[us.ID]
+		}
+	}
+	return sts
+}
+
+func (e *Engine) handlePlugins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := codec.NewEncoder(w, jh).Encode(e.status()); err != nil {
+		e.log.Warning("Monitor error: ", err)
+	}
+}
+
+// startMonitor starts the monitoring API on the address. The address is not
+// changed by reload.
+func (e *Engine) startMonitor(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/plugins", e.handlePlugins)
+	mux.HandleFunc("/metrics", e.handleMetrics)
+	e.log.Infof("Monitoring API listening on %s", l.Addr())
+	go http.Serve(l, mux)
+	return nil
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+)
+
+func TestPluginsAPI(t *testing.T) {
+	e := New()
+	ins := NewInstance("out-test", e)
+	for _, id := range []int32{2, 1} {
+		defer ins.AddExecUnit(id, map[string]interface{}{"type": "test"}, nil).close()
+	}
+	e.plugins[ins.name] = ins
+	stopped := NewInstance("in-test", e)
+	close(stopped.doneC)
+	e.plugins[stopped.name] = stopped
+
+	w := httptest.NewRecorder()
+	e.handlePlugins(w, httptest.NewRequest("GET", "/api/plugins", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var sts []*instanceStatus
+	if !assert.NoError(t, codec.NewDecoderBytes(w.Body.Bytes(), jh).Decode(&sts)) {
+		return
+	}
+	if !assert.Len(t, sts, 2) {
+		return
+	}
+	assert.Equal(t, "in-test", sts[0].Name)
+	assert.Equal(t, "stopped", sts[0].State)
+	assert.Empty(t, sts[0].Units)
+
+	// Stats are not available until the plugin is running
+	assert.Equal(t, "out-test", sts[1].Name)
+	assert.Equal(t, "starting", sts[1].State)
+	if assert.Len(t, sts[1].Units, 2) {
+		for i, us := range sts[1].Units {
+			assert.Equal(t, int32(i+1), us.ID)
+			assert.Equal(t, "test", us.Config["type"])
+			assert.Nil(t, us.Stats)
+		}
+	}
+}
+
+func TestStatusDeadline(t *testing.T) {
+	defer func(d time.Duration) { statsTimeout = d }(statsTimeout)
+	statsTimeout = 200 * time.Millisecond
+
+	// None of the plugins respond to the stats request
+	e := New()
+	for i := 0; i < 3; i++ {
+		ins := NewInstance(fmt.Sprintf("out-test%d", i), e)
+		ins.wp = pipe.NewInterProcess(nil, ioutil.Discard)
+		ins.ready = true
+		ins.info = &message.PluginInfo{Capabilities: []string{message.CapStats}}
+		e.plugins[ins.name] = ins
+	}
+
+	start := time.Now()
+	sts := e.status()
+	elapsed := time.Since(start)
+	assert.Len(t, sts, 3)
+	for _, st := range sts {
+		assert.Equal(t, "running", st.State)
+	}
+	assert.True(t, elapsed >= statsTimeout, "%v", elapsed)
+	assert.True(t, elapsed < 2*statsTimeout, "%v", elapsed)
+}
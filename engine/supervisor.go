@@ -0,0 +1,330 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+)
+
+// Restart strategies of plugin processes
+const (
+	RestartAlways  = "always"
+	RestartOnError = "on_error"
+	RestartNever   = "never"
+)
+
+var errGaveUp = errors.New("Too many restarts")
+
+// SupervisorOptions controls how plugin processes are restarted and stopped.
+// Zero values of per-plugin options are inherited from the [supervisor]
+// section.
+type SupervisorOptions struct {
+	Restart string `toml:"restart"`
+	// Delay before the first restart, doubled on each crash up to the max
+	RestartDelay    buffer.Duration `toml:"restart_delay"`
+	MaxRestartDelay buffer.Duration `toml:"max_restart_delay"`
+	// The plugin fails if restarted more than MaxRestarts times within the
+	// window. Unlimited if negative, or zero in the [supervisor] section.
+	MaxRestarts   int             `toml:"max_restarts"`
+	RestartWindow buffer.Duration `toml:"restart_window"`
+	// Time to wait for the plugin to stop before killed
+	ShutdownGrace buffer.Duration `toml:"shutdown_grace"`
+}
+
+func (o *SupervisorOptions) SetDefault() {
+	if o.Restart == "" {
+		o.Restart = RestartOnError
+	}
+	if o.RestartDelay == 0 {
+		o.RestartDelay = buffer.Duration(3 * time.Second)
+	}
+	if o.MaxRestartDelay == 0 {
+		o.MaxRestartDelay = buffer.Duration(time.Minute)
+	}
+	if o.RestartWindow == 0 {
+		o.RestartWindow = buffer.Duration(10 * time.Minute)
+	}
+	if o.ShutdownGrace == 0 {
+		o.ShutdownGrace = buffer.Duration(10 * time.Second)
+	}
+}
+
+// inherit fills zero values with the base options.
+func (o SupervisorOptions) inherit(base *SupervisorOptions) *SupervisorOptions {
+	if o.Restart == "" {
+		o.Restart = base.Restart
+	}
+	if o.RestartDelay == 0 {
+		o.RestartDelay = base.RestartDelay
+	}
+	if o.MaxRestartDelay == 0 {
+		o.MaxRestartDelay = base.MaxRestartDelay
+	}
+	if o.MaxRestarts == 0 {
+		o.MaxRestarts = base.MaxRestarts
+	}
+	if o.RestartWindow == 0 {
+		o.RestartWindow = base.RestartWindow
+	}
+	if o.ShutdownGrace == 0 {
+		o.ShutdownGrace = base.ShutdownGrace
+	}
+	return &o
+}
+
+func (o *SupervisorOptions) validate() error {
+	switch o.Restart {
+	case "", RestartAlways, RestartOnError, RestartNever:
+	default:
+		return fmt.Errorf("restart must be %s, %s or %s", RestartAlways, RestartOnError, RestartNever)
+	}
+	if o.RestartDelay < 0 || o.MaxRestartDelay < 0 || o.RestartWindow < 0 || o.ShutdownGrace < 0 {
+		return errors.New("Durations must not be negative")
+	}
+	return nil
+}
+
+// process runs a plugin process, and restarts it according to the options.
+type process struct {
+	name    string
+	opts    *SupervisorOptions
+	prepare func(*exec.Cmd)
+	// Searched for the executable, only PATH if nil
+	dirs *pluginDirs
+	// Called when the process exits unexpectedly, and when the process is
+	// given up with errGaveUp
+	crash    func(error)
+	cmd      *exec.Cmd
+	stopping bool
+	wakeC    chan struct{}
+	doneC    chan struct{}
+	m        sync.Mutex
+}
+
+func newProcess(name string, opts *SupervisorOptions, prepare func(*exec.Cmd), crash func(error)) *process {
+	return &process{
+		name:    name,
+		opts:    opts,
+		prepare: prepare,
+		crash:   crash,
+	}
+}
+
+func (p *process) setOptions(opts *SupervisorOptions) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.opts = opts
+}
+
+func (p *process) options() *SupervisorOptions {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.opts
+}
+
+// Start starts the process unless running.
+func (p *process) Start() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.doneC != nil {
+		select {
+		case <-p.doneC:
+		default:
+			return
+		}
+	}
+	p.stopping = false
+	p.wakeC = make(chan struct{})
+	p.doneC = make(chan struct{})
+	go p.run(p.doneC)
+}
+
+func (p *process) run(doneC chan struct{}) {
+	defer close(doneC)
+	var restarts []time.Time
+	var delay time.Duration
+	for {
+		started := time.Now()
+		err := p.exec()
+		if p.isStopping() {
+			return
+		}
+		if err != nil {
+			p.crash(err)
+		}
+
+		opts := p.options()
+		if opts.Restart == RestartNever || (opts.Restart == RestartOnError && err == nil) {
+			return
+		}
+		now := time.Now()
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > time.Duration(opts.RestartWindow) {
+			restarts = restarts[1:]
+		}
+		if opts.MaxRestarts > 0 && len(restarts) > opts.MaxRestarts {
+			p.crash(errGaveUp)
+			return
+		}
+
+		// The backoff is reset once the process has been running stably
+		if delay == 0 || now.Sub(started) > time.Duration(opts.RestartWindow) {
+			delay = time.Duration(opts.RestartDelay)
+		} else if delay *= 2; delay > time.Duration(opts.MaxRestartDelay) {
+			delay = time.Duration(opts.MaxRestartDelay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-p.wakeC:
+			return
+		}
+	}
+}
+
+func (p *process) exec() error {
+	path, err := p.dirs.look(p.name)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path)
+	p.prepare(cmd)
+	p.m.Lock()
+	if p.stopping {
+		p.m.Unlock()
+		return nil
+	}
+	err = cmd.Start()
+	if err == nil {
+		p.cmd = cmd
+	}
+	p.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+func (p *process) isStopping() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.stopping
+}
+
+// Stop prevents the process from restarting, and kills it if it doesn't exit
+// within the grace period.
+func (p *process) Stop() {
+	p.m.Lock()
+	if p.doneC == nil || p.stopping {
+		p.m.Unlock()
+		return
+	}
+	p.stopping = true
+	close(p.wakeC)
+	cmd, doneC := p.cmd, p.doneC
+	grace := time.Duration(p.opts.ShutdownGrace)
+	p.m.Unlock()
+
+	if cmd == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-doneC:
+		case <-time.After(grace):
+			cmd.Process.Kill()
+		}
+	}()
+}
+
+// Interrupt sends SIGINT to the running process. Plugins don't exit on it,
+// but stop blocking on full buffers.
+func (p *process) Interrupt() {
+	p.m.Lock()
+	cmd := p.cmd
+	p.m.Unlock()
+	if cmd != nil {
+		cmd.Process.Signal(os.Interrupt)
+	}
+}
+
+// Kill kills the running process, which is restarted as crashed.
+func (p *process) Kill() {
+	p.m.Lock()
+	cmd, stopping := p.cmd, p.stopping
+	p.m.Unlock()
+	if cmd != nil && !stopping {
+		cmd.Process.Kill()
+	}
+}
+
+// Done returns a channel closed when the process is no longer supervised.
+func (p *process) Done() <-chan struct{} {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.doneC == nil {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	return p.doneC
+}
+
+// setSupervisor applies the supervisor options of the config. Running
+// processes use the new options from the next restart.
+func (e *Engine) setSupervisor(conf *Config) {
+	sup := conf.Supervisor.SupervisorOptions
+	sup.SetDefault()
+	e.sup, e.sups = &sup, conf.Supervisor.Plugin
+	for _, ins := range e.plugins {
+		if ins.proc != nil {
+			ins.proc.setOptions(e.supervisorOptions(ins.name))
+		}
+	}
+}
+
+func (e *Engine) supervisorOptions(name string) *SupervisorOptions {
+	if opts, ok := e.sups[name]; ok {
+		return opts.inherit(e.sup)
+	}
+	return e.sup
+}
+
+// fail marks the plugin failed after given up restarting it.
+func (e *Engine) fail(ins *Instance) {
+	ins.m.Lock()
+	ins.failed = true
+	ins.ready = false
+	crashes := ins.crashes
+	ins.m.Unlock()
+	ins.wakeUnits()
+	e.log.Criticalf("%s plugin failed: gave up restarting after %d crashes", ins.name, crashes)
+	e.Filter(message.NewEvent("fluxion.plugin.failed", map[string]interface{}{
+		"plugin":  ins.name,
+		"crashes": crashes,
+	}))
+}
+
+// restartFailed starts the failed plugin processes again on reload, unless
+// they are no longer used.
+func (e *Engine) restartFailed() {
+	e.rm.RLock()
+	defer e.rm.RUnlock()
+	for _, ins := range e.plugins {
+		ins.m.Lock()
+		restart := ins.failed && ins.proc != nil && len(ins.units) > 0
+		if restart {
+			ins.failed = false
+		}
+		ins.m.Unlock()
+		if restart {
+			e.log.Infof("Restarting failed %s plugin", ins.name)
+			ins.proc.Start()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+)
+
+func TestSupervisorConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "fluxion-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[supervisor]
+restart = "always"
+max_restarts = 5
+
+[supervisor.plugin.out-forward]
+restart_delay = "1s"
+max_restarts = -1
+
+[supervisor.plugin.out-file]
+restart = "sometimes"
+`)
+	f.Close()
+
+	conf, err := LoadConfig(f.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = conf.Validate()
+	if assert.IsType(t, Errors{}, err) {
+		assert.Len(t, err.(Errors), 1)
+		assert.Contains(t, err.Error(), "[supervisor.plugin.out-file]: restart must be")
+	}
+
+	delete(conf.Supervisor.Plugin, "out-file")
+	e := New()
+	assert.NoError(t, e.Apply(conf))
+	opts := e.supervisorOptions("out-forward")
+	assert.Equal(t, RestartAlways, opts.Restart)
+	assert.Equal(t, buffer.Duration(time.Second), opts.RestartDelay)
+	assert.Equal(t, -1, opts.MaxRestarts)
+	assert.Equal(t, buffer.Duration(10*time.Second), opts.ShutdownGrace)
+	assert.Equal(t, 5, e.supervisorOptions("out-stdout").MaxRestarts)
+}
+
+func TestProcessGiveUp(t *testing.T) {
+	opts := &SupervisorOptions{
+		RestartDelay: buffer.Duration(time.Millisecond),
+		MaxRestarts:  2,
+	}
+	opts.SetDefault()
+	var errs []error
+	p := newProcess("no-such-plugin", opts, func(*exec.Cmd) {}, func(err error) {
+		errs = append(errs, err)
+	})
+	p.Start()
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Process is not given up")
+	}
+	if assert.Len(t, errs, 4) {
+		assert.Equal(t, errGaveUp, errs[3])
+	}
+}
+
+func TestRestartFailed(t *testing.T) {
+	e := New()
+	ins := NewInstance("out-embedded", e)
+	ins.embedded = true
+	rp := pipe.NewInProcess()
+	ins.rp, ins.wp = rp, pipe.NewInProcess()
+	u := ins.AddExecUnit(1, nil, nil)
+	defer u.close()
+	e.plugins[ins.name] = ins
+
+	// The refused embedded plugin is stopped, but not failed
+	e.refuse(ins, errors.New("incompatible"))
+	assert.False(t, ins.isFailed())
+
+	// Embedded plugins are never restarted
+	ins.failed = true
+	e.restartFailed()
+	assert.True(t, ins.isFailed())
+
+	// The plugin terminated can be started again
+	for i := 0; i < 2; i++ {
+		ins.Start()
+		ins.m.Lock()
+		doneC := ins.doneC
+		ins.m.Unlock()
+		rp.Write(&message.Message{Type: message.TypTerminated})
+		select {
+		case <-doneC:
+		case <-time.After(time.Second):
+			t.Fatal("Plugin is not terminated")
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package engine
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -11,34 +14,181 @@ type Emitter interface {
 	Emit(*message.Event) error
 }
 
+// Matcher reports whether the tag matches a rule. *regexp.Regexp satisfies
+// it.
+type Matcher interface {
+	MatchString(string) bool
+}
+
 type TagRouter struct {
-	patterns []*regexp.Regexp
+	patterns []Matcher
 	values   []Emitter
+	cont     []bool
+}
+
+func (t *TagRouter) Add(m Matcher, e Emitter) {
+	t.add(m, e, false)
+}
+
+// AddContinue adds the emitter which doesn't stop routing, so that the
+// following emitters matching the tag receive the event as well.
+func (t *TagRouter) AddContinue(m Matcher, e Emitter) {
+	t.add(m, e, true)
 }
 
-func (t *TagRouter) Add(re *regexp.Regexp, e Emitter) {
-	t.patterns = append(t.patterns, re)
+func (t *TagRouter) add(m Matcher, e Emitter, cont bool) {
+	t.patterns = append(t.patterns, m)
 	t.values = append(t.values, e)
+	t.cont = append(t.cont, cont)
 }
 
 func (t *TagRouter) Route(tag string) Emitter {
-	for i, re := range t.patterns {
-		if re.MatchString(tag) {
+	for i, m := range t.patterns {
+		if m.MatchString(tag) {
 			return t.values[i]
 		}
 	}
 	return nil
 }
 
+// RouteAll returns the emitters matching the tag, up to the first one added
+// without continue.
+func (t *TagRouter) RouteAll(tag string) []Emitter {
+	var emitters []Emitter
+	for i, m := range t.patterns {
+		if m.MatchString(tag) {
+			emitters = append(emitters, t.values[i])
+			if !t.cont[i] {
+				break
+			}
+		}
+	}
+	return emitters
+}
+
+// tagPatterns matches tags which match any of include patterns and none of
+// exclude patterns. Without include patterns, all tags are included.
+type tagPatterns struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func (p *tagPatterns) MatchString(tag string) bool {
+	for _, re := range p.exclude {
+		if re.MatchString(tag) {
+			return false
+		}
+	}
+	if len(p.include) == 0 {
+		return true
+	}
+	for _, re := range p.include {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileMatch compiles a match rule. The rule is a list of space separated
+// Fluentd style patterns, each can be negated by "!". A rule prefixed with
+// "regex:" is compiled as a regular expression as is.
+func compileMatch(s string) (Matcher, error) {
+	if strings.HasPrefix(s, "regex:") {
+		return regexp.Compile(strings.TrimPrefix(s, "regex:"))
+	}
+
+	p := &tagPatterns{}
+	for _, pat := range splitPatterns(s) {
+		exclude := strings.HasPrefix(pat, "!")
+		re, err := compileTag(strings.TrimPrefix(pat, "!"))
+		if err != nil {
+			return nil, err
+		}
+		if exclude {
+			p.exclude = append(p.exclude, re)
+		} else {
+			p.include = append(p.include, re)
+		}
+	}
+	if len(p.include) == 1 && len(p.exclude) == 0 {
+		return p.include[0], nil
+	}
+	if len(p.include) == 0 && len(p.exclude) == 0 {
+		return nil, errors.New("Empty match pattern")
+	}
+	return p, nil
+}
+
+// splitPatterns splits s by spaces except inside braces.
+func splitPatterns(s string) []string {
+	var pats []string
+	var depth, start int
+	for i, c := range s {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ' ', '\t':
+			if depth > 0 {
+				continue
+			}
+			if i > start {
+				pats = append(pats, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		pats = append(pats, s[start:])
+	}
+	return pats
+}
+
+// regexMeta are characters of regular expressions which tag patterns never
+// use. Patterns had been regular expressions before "regex:" was introduced.
+const regexMeta = `^$\+()[]|?`
+
+// compileTag converts a Fluentd style pattern into a regular expression.
+// "*" matches a tag part, "**" matches zero or more tag parts and {a,b}
+// matches either a or b.
 func compileTag(s string) (*regexp.Regexp, error) {
-	if s == "**" || s == "*" {
-		s = `.*`
-	} else {
-		s = strings.Replace(s, `.`, `\.`, -1)
-		s = strings.Replace(s, `**`, `(\..+|)`, -1)
-		s = strings.Replace(s, `\.(\..+|)`, `(\..+|)`, -1)
-		s = strings.Replace(s, `*`, `.*`, -1)
-	}
-	s = `^` + s + `$`
-	return regexp.Compile(s)
+	if strings.ContainsAny(s, regexMeta) || strings.HasPrefix(s, ".*") {
+		return nil, fmt.Errorf("%s looks like a regular expression, prefix the match with regex:", s)
+	}
+	var depth int
+	b := new(bytes.Buffer)
+	b.WriteString(`^`)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], `.**`):
+			b.WriteString(`(\..+|)`)
+			i += 2
+		case strings.HasPrefix(s[i:], `**.`):
+			b.WriteString(`(.+\.|)`)
+			i += 2
+		case strings.HasPrefix(s[i:], `**`):
+			b.WriteString(`.*`)
+			i++
+		case s[i] == '*':
+			b.WriteString(`[^.]*`)
+		case s[i] == '{':
+			depth++
+			b.WriteString(`(`)
+		case s[i] == '}' && depth > 0:
+			depth--
+			b.WriteString(`)`)
+		case s[i] == ',' && depth > 0:
+			b.WriteString(`|`)
+		case s[i] == ' ' && depth > 0:
+		default:
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("Unclosed brace in tag pattern: %s", s)
+	}
+	b.WriteString(`$`)
+	return regexp.Compile(b.String())
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/message"
 )
 
 func TestCompile(t *testing.T) {
@@ -14,7 +15,7 @@ func TestCompile(t *testing.T) {
 	assert.Equal(t, `^foo\.bar$`, re.String())
 
 	re, _ = compileTag("foo.*.bar")
-	assert.Equal(t, `^foo\..*\.bar$`, re.String())
+	assert.Equal(t, `^foo\.[^.]*\.bar$`, re.String())
 
 	re, _ = compileTag("foo.**")
 	assert.Equal(t, `^foo(\..+|)$`, re.String())
@@ -22,3 +23,59 @@ func TestCompile(t *testing.T) {
 	re, _ = compileTag("**")
 	assert.Equal(t, `^.*$`, re.String())
 }
+
+func TestCompileMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		match   []string
+		unmatch []string
+	}{
+		{"foo.*", []string{"foo.bar"}, []string{"foo", "foo.bar.baz"}},
+		{"foo.**", []string{"foo", "foo.bar", "foo.bar.baz"}, []string{"foobar"}},
+		{"**.bar", []string{"bar", "foo.bar"}, []string{"foobar"}},
+		{"foo.**.bar", []string{"foo.bar", "foo.x.y.bar"}, []string{"foo.baz"}},
+		{"foo.{bar,baz}", []string{"foo.bar", "foo.baz"}, []string{"foo.qux"}},
+		{"foo.* bar.*", []string{"foo.a", "bar.b"}, []string{"baz.c"}},
+		{"foo.** !foo.secret", []string{"foo.a"}, []string{"foo.secret"}},
+		{"!foo.**", []string{"bar"}, []string{"foo.a"}},
+		{"regex:^foo\\.", []string{"foo.a", "foo.a.b"}, []string{"bar.foo.a"}},
+	}
+	for _, c := range cases {
+		m, err := compileMatch(c.pattern)
+		assert.NoError(t, err)
+		for _, tag := range c.match {
+			assert.True(t, m.MatchString(tag), "%s should match %s", c.pattern, tag)
+		}
+		for _, tag := range c.unmatch {
+			assert.False(t, m.MatchString(tag), "%s should not match %s", c.pattern, tag)
+		}
+	}
+
+	_, err := compileMatch("foo.{bar")
+	assert.Error(t, err)
+
+	// Regular expressions without "regex:" are refused
+	for _, pattern := range []string{"^foo\\.", ".*", "foo.bar$", "foo\\.bar", "(foo|bar)", "foo.+"} {
+		_, err = compileMatch(pattern)
+		assert.Error(t, err, pattern)
+	}
+}
+
+type nopEmitter int
+
+func (nopEmitter) Emit(*message.Event) error {
+	return nil
+}
+
+func TestRouteAll(t *testing.T) {
+	tr := &TagRouter{}
+	foo, _ := compileMatch("foo.**")
+	all, _ := compileMatch("**")
+	tr.AddContinue(foo, nopEmitter(1))
+	tr.Add(foo, nopEmitter(2))
+	tr.Add(all, nopEmitter(3))
+
+	assert.Equal(t, []Emitter{nopEmitter(1), nopEmitter(2)}, tr.RouteAll("foo.bar"))
+	assert.Equal(t, []Emitter{nopEmitter(3)}, tr.RouteAll("bar"))
+	assert.Equal(t, nopEmitter(1), tr.Route("foo.bar"))
+}
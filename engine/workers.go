@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+)
+
+// Ways to choose the worker of an event
+const (
+	DispatchRoundRobin = "round_robin"
+	DispatchTag        = "tag"
+	DispatchKey        = "key"
+)
+
+// workerGroup spreads events over units run by separate worker processes.
+// Each unit has its own buffer in its process.
+type workerGroup struct {
+	units    []*ExecUnit
+	dispatch string
+	key      string
+	next     uint32
+	CopyMode CopyMode
+}
+
+func (g *workerGroup) Emit(ev *message.Event) error {
+	return g.units[g.index(ev)].Emit(ev)
+}
+
+func (g *workerGroup) index(ev *message.Event) int {
+	n := uint32(len(g.units))
+	switch g.dispatch {
+	case DispatchTag:
+		return int(hash(ev.Tag) % n)
+	case DispatchKey:
+		return int(hash(fmt.Sprint(ev.Record[g.key])) % n)
+	}
+	return int(atomic.AddUint32(&g.next, 1) % n)
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+type workersConfig struct {
+	workers  int
+	dispatch string
+	key      string
+}
+
+// parseWorkers reads workers, dispatch and dispatch_key from the plugin
+// config.
+func parseWorkers(conf map[string]interface{}) (*workersConfig, error) {
+	wc := &workersConfig{workers: 1, dispatch: DispatchRoundRobin}
+	switch v := conf["workers"].(type) {
+	case nil:
+	case int64:
+		wc.workers = int(v)
+	case int:
+		wc.workers = v
+	default:
+		return nil, errors.New("workers must be an integer")
+	}
+	if wc.workers < 1 {
+		return nil, errors.New("workers must be positive")
+	}
+	if v, ok := conf["dispatch"]; ok {
+		if wc.dispatch, ok = v.(string); !ok {
+			return nil, errors.New("dispatch must be a string")
+		}
+	}
+	switch wc.dispatch {
+	case DispatchRoundRobin, DispatchTag:
+	case DispatchKey:
+		if wc.key, _ = conf["dispatch_key"].(string); wc.key == "" {
+			return nil, errors.New("dispatch_key is required to dispatch by key")
+		}
+	default:
+		return nil, fmt.Errorf("dispatch must be %s, %s or %s", DispatchRoundRobin, DispatchTag, DispatchKey)
+	}
+	return wc, nil
+}
+
+// addWorkers adds a unit to each worker process of the plugin. The emitter
+// is the unit itself if only one worker is configured.
+func (e *Engine) addWorkers(name string, conf map[string]interface{}, bopts *buffer.Options) ([]*ExecUnit, Emitter, error) {
+	wc, err := parseWorkers(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	units := make([]*ExecUnit, wc.workers)
+	for k := range units {
+		units[k] = e.addExecUnit(e.workerInstance(name, k), conf, unitBuffer(name, k, conf, bopts))
+	}
+	if len(units) == 1 {
+		return units, units[0], nil
+	}
+	return units, &workerGroup{units: units, dispatch: wc.dispatch, key: wc.key}, nil
+}
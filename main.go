@@ -2,70 +2,91 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"strings"
+	"os"
+	"strconv"
+	"text/tabwriter"
 
-	"github.com/BurntSushi/toml"
-	"github.com/yosisa/fluxion/buffer"
 	"github.com/yosisa/fluxion/engine"
 )
 
-var config struct {
-	Buffer []*buffer.Options
-	Input  []map[string]interface{}
-	Filter []map[string]interface{}
-}
-
 func main() {
 	var configPath string
+	var check, listPlugins bool
 	flag.StringVar(&configPath, "c", "/etc/fluxion.toml", "config file")
+	flag.BoolVar(&check, "check", false, "check the config file and exit")
+	flag.BoolVar(&listPlugins, "list-plugins", false, "list available plugins and exit")
 	flag.Parse()
 
-	b, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		log.Fatal("Failed to load config: ", err)
+	if check {
+		os.Exit(checkConfig(configPath))
 	}
-	_, err = toml.Decode(string(b), &config)
-	if err != nil {
-		log.Fatal("Failed to load config: ", err)
+	if listPlugins {
+		os.Exit(printPlugins(configPath))
 	}
 
 	eng := engine.New()
-	for _, bopts := range config.Buffer {
-		eng.RegisterBuffer(bopts)
+	if err := eng.Load(configPath); err != nil {
+		log.Fatal("Failed to load config: ", err)
+	}
+	eng.Start()
+	eng.Wait()
+}
+
+func checkConfig(path string) int {
+	conf, err := engine.LoadConfig(path)
+	if err == nil {
+		err = engine.Check(conf)
 	}
-	for _, conf := range config.Input {
-		eng.RegisterInputPlugin(conf)
+	if errs, ok := err.(engine.Errors); ok {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
 	}
-	for _, conf := range config.Filter {
-		must(eng.RegisterFilterPlugin(conf))
+	fmt.Printf("%s: OK\n", path)
+	return 0
+}
+
+// printPlugins lists the plugins found with plugin_dir of the config. The
+// config is optional, only PATH is searched without it.
+func printPlugins(path string) int {
+	var dirs []string
+	if conf, err := engine.LoadConfig(path); err == nil {
+		dirs = conf.Engine.PluginDir
+	} else if !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
 	}
 
-	// To support `output:...` form, re-decoding with relax type is needed.
-	var c map[string][]map[string]interface{}
-	toml.Decode(string(b), &c)
-	for k, v := range c {
-		keys := strings.SplitN(k, ":", 2)
-		if strings.ToLower(keys[0]) != "output" {
-			continue
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKIND\tPROTOCOL\tVERSION\tPATH")
+	for _, p := range engine.ListPlugins(dirs) {
+		kind, proto, version, loc := "-", "-", "-", p.Path
+		if loc == "" {
+			loc = "(embedded)"
 		}
-
-		var name string
-		if len(keys) == 2 {
-			name = keys[1]
+		switch {
+		case p.Shadowed:
+			loc += " (shadowed)"
+		case p.Err != nil:
+			loc += " (error: " + p.Err.Error() + ")"
 		}
-		for _, conf := range v {
-			must(eng.RegisterOutputPlugin(name, conf))
+		if p.Info != nil {
+			proto = strconv.Itoa(int(p.Info.ProtoVer))
+			if p.Info.Kind != "" {
+				kind = p.Info.Kind
+			}
+			if p.Info.Version != "" {
+				version = p.Info.Version
+			}
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name, kind, proto, version, loc)
 	}
-
-	eng.Start()
-	eng.Wait()
-}
-
-func must(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
+	w.Flush()
+	return 0
 }
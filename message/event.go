@@ -6,6 +6,16 @@ type Event struct {
 	Tag    string                 `codec:"tag"`
 	Time   time.Time              `codec:"time"`
 	Record map[string]interface{} `codec:"record"`
+	// Set if the input waits for the event to be acknowledged by outputs
+	Origin *Origin `codec:"origin,omitempty"`
+}
+
+// Origin identifies an event emitted by an input unit. Copies of the event
+// share the origin, and the input is acknowledged after all of them are
+// written.
+type Origin struct {
+	Unit int32  `codec:"unit"`
+	Seq  uint64 `codec:"seq"`
 }
 
 func NewEvent(tag string, v map[string]interface{}) *Event {
@@ -15,3 +25,49 @@ func NewEvent(tag string, v map[string]interface{}) *Event {
 func NewEventWithTime(tag string, time time.Time, r map[string]interface{}) *Event {
 	return &Event{Tag: tag, Time: time, Record: r}
 }
+
+// Copy returns a shallow copy of the event. The record is copied, but nested
+// maps and slices are shared with the original.
+func (e *Event) Copy() *Event {
+	r := make(map[string]interface{}, len(e.Record))
+	for k, v := range e.Record {
+		r[k] = v
+	}
+	return &Event{Tag: e.Tag, Time: e.Time, Record: r, Origin: e.Origin}
+}
+
+// DeepCopy returns a copy of the event which shares nothing with the
+// original.
+func (e *Event) DeepCopy() *Event {
+	r := make(map[string]interface{}, len(e.Record))
+	for k, v := range e.Record {
+		r[k] = deepCopy(v)
+	}
+	return &Event{Tag: e.Tag, Time: e.Time, Record: r, Origin: e.Origin}
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(typed))
+		for k, v := range typed {
+			m[k] = deepCopy(v)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(typed))
+		for k, v := range typed {
+			m[k] = deepCopy(v)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(typed))
+		for i, v := range typed {
+			l[i] = deepCopy(v)
+		}
+		return l
+	case []byte:
+		return append([]byte(nil), typed...)
+	}
+	return v
+}
@@ -1,8 +1,10 @@
 package message
 
 import (
+	"errors"
 	"io"
 	"reflect"
+	"time"
 
 	"github.com/ugorji/go/codec"
 	"github.com/yosisa/fluxion/buffer"
@@ -29,28 +31,80 @@ const (
 	TypEvent
 	TypEventChain
 	TypStdout
+	TypEventSecondary
+	TypStopUnit
+	TypCheck
+	TypCheckResult
+	TypStatsRequest
+	TypStats
+	TypPause
+	TypResume
+	TypAck
+	TypHandoff
+	TypEventBatch
+	TypProtocolError
+	TypUnitFailed
+)
+
+// Limits of events coalesced into a TypEventBatch by senders. A batch is sent
+// when it's full, or when the first event has waited for BatchDelay.
+const (
+	BatchSize  = 256
+	BatchDelay = 5 * time.Millisecond
+)
+
+// Versions of the protocol. Version 2 added sequences of events, and version
+// 3 framed messages and capabilities of PluginInfo. Messages before the
+// version is negotiated are sent in MinProtoVer.
+const (
+	ProtoVer    uint8 = 3
+	MinProtoVer uint8 = 1
 )
 
 type Message struct {
-	Type    MessageType
-	UnitID  int32
+	Type   MessageType
+	UnitID int32
+	// Sequence of the event sent to the unit, confirmed by TypHandoff. It's
+	// encoded only for TypEvent.
+	Seq     uint64
 	Payload interface{}
 }
 
-func (m *Message) Encode(enc Encoder) (err error) {
+func (m *Message) Encode(enc Encoder) error {
+	return m.EncodeVersion(enc, ProtoVer)
+}
+
+// EncodeVersion encodes the message for the peer of the protocol version.
+func (m *Message) EncodeVersion(enc Encoder, ver uint8) (err error) {
 	if err = enc.Encode(m.UnitID); err != nil {
 		return
 	}
+	if m.Type == TypEvent && ver >= 2 {
+		if err = enc.Encode(m.Seq); err != nil {
+			return
+		}
+	}
 	return enc.Encode(m.Payload)
 }
 
-func (m *Message) Decode(dec Decoder) (err error) {
+func (m *Message) Decode(dec Decoder) error {
+	return m.DecodeVersion(dec, ProtoVer)
+}
+
+// DecodeVersion decodes the message sent by the peer of the protocol version.
+func (m *Message) DecodeVersion(dec Decoder, ver uint8) (err error) {
 	if err = dec.Decode(&m.UnitID); err != nil {
 		return
 	}
+	if m.Type == TypEvent && ver >= 2 {
+		if err = dec.Decode(&m.Seq); err != nil {
+			return
+		}
+	}
 
 	switch m.Type {
-	case TypInfoResponse:
+	case TypInfoRequest, TypInfoResponse:
+		// Requests by older engines have no payload
 		var info PluginInfo
 		err = dec.Decode(&info)
 		m.Payload = &info
@@ -58,11 +112,41 @@ func (m *Message) Decode(dec Decoder) (err error) {
 		var opts buffer.Options
 		err = dec.Decode(&opts)
 		m.Payload = &opts
-	case TypConfigure:
+	case TypConfigure, TypUnitFailed:
 		var s string
 		err = dec.Decode(&s)
 		m.Payload = s
-	case TypEvent, TypEventChain:
+	case TypCheck:
+		var req CheckRequest
+		err = dec.Decode(&req)
+		m.Payload = &req
+	case TypAck:
+		var origins []Origin
+		err = dec.Decode(&origins)
+		m.Payload = origins
+	case TypStdout:
+		var b []byte
+		err = dec.Decode(&b)
+		m.Payload = b
+	case TypHandoff:
+		var seqs []uint64
+		err = dec.Decode(&seqs)
+		m.Payload = seqs
+	case TypEventBatch:
+		var batch EventBatch
+		if err = dec.Decode(&batch); err == nil {
+			err = batch.validate()
+		}
+		m.Payload = &batch
+	case TypProtocolError:
+		var perr ProtocolError
+		err = dec.Decode(&perr)
+		m.Payload = &perr
+	case TypStats:
+		var stats Stats
+		err = dec.Decode(&stats)
+		m.Payload = &stats
+	case TypEvent, TypEventChain, TypEventSecondary:
 		var ev Event
 		err = dec.Decode(&ev)
 		m.Payload = &ev
@@ -72,8 +156,178 @@ func (m *Message) Decode(dec Decoder) (err error) {
 	return
 }
 
+// EventBatch carries events of a unit in a message.
+type EventBatch struct {
+	// Set if the events are filtered by the unit, as TypEventChain
+	Chain bool `codec:"chain,omitempty"`
+	// Sequences of the events sent to the unit, as Message.Seq
+	Seqs   []uint64 `codec:"seqs,omitempty"`
+	Events []*Event `codec:"events"`
+}
+
+func (b *EventBatch) validate() error {
+	if len(b.Seqs) > 0 && len(b.Seqs) != len(b.Events) {
+		return errors.New("sequences don't match events")
+	}
+	for _, ev := range b.Events {
+		if ev == nil {
+			return errors.New("nil event in batch")
+		}
+	}
+	return nil
+}
+
+// ProtocolError is reported by the plugin when a message from the engine is
+// not decodable and skipped.
+type ProtocolError struct {
+	// Type of the skipped message
+	Type  MessageType `codec:"type"`
+	Error string      `codec:"error"`
+}
+
+// Kinds of plugins
+const (
+	KindInput  = "input"
+	KindFilter = "filter"
+	KindOutput = "output"
+)
+
+// Optional capabilities of the engine and plugins
+const (
+	// Events are sent in TypEventBatch
+	CapBatch = "batch"
+	// Inputs are acknowledged by TypAck
+	CapAck = "ack"
+	// Events are confirmed by TypHandoff, and replayed if not confirmed
+	CapHandoff = "handoff"
+	// Stats are reported by TypStats
+	CapStats = "stats"
+	// Inputs are paused by TypPause and TypResume
+	CapPause = "pause"
+	// Chunks of buffers are compressed
+	CapCompress = "compress"
+	// Units are initialized by TypCheck without started
+	CapCheck = "check"
+	// Units failing to be configured or started are reported by TypUnitFailed
+	CapFail = "fail"
+)
+
+// PluginInfo is exchanged by TypInfoRequest and TypInfoResponse. The engine
+// sends its own version and capabilities, and the plugin replies with them
+// and the description of itself. Fields other than ProtoVer are empty for
+// older peers.
 type PluginInfo struct {
 	ProtoVer uint8 `codec:"proto_ver"`
+	// One of the kinds, empty in requests
+	Kind string `codec:"kind,omitempty"`
+	// Version of the plugin itself, if the plugin tells
+	Version string `codec:"version,omitempty"`
+	// Message types handled by the plugin
+	Types        []MessageType `codec:"types,omitempty"`
+	Capabilities []string      `codec:"capabilities,omitempty"`
+	// Keys accepted in the config of the plugin, nil if unknown
+	Config []*ConfigField `codec:"config,omitempty"`
+}
+
+// ConfigField describes a key of the plugin config.
+type ConfigField struct {
+	Name string `codec:"name"`
+	// Kind of the value, such as string, int or bool
+	Type string `codec:"type"`
+}
+
+// Has reports whether the capability is supported. It's false for nil.
+func (i *PluginInfo) Has(cap string) bool {
+	if i == nil {
+		return false
+	}
+	for _, c := range i.Capabilities {
+		if c == cap {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts reports whether the message type is handled by the plugin. It's
+// false for nil.
+func (i *PluginInfo) Accepts(typ MessageType) bool {
+	if i == nil {
+		return false
+	}
+	for _, t := range i.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyTypes are handled by plugins of version 1 and 2, which don't report
+// their message types.
+var legacyTypes = []MessageType{
+	TypInfoRequest, TypBufferOption, TypConfigure, TypStart, TypStop, TypEvent,
+}
+
+// Negotiate returns the info used to talk with the peer. The version is the
+// lower one, and capabilities are the ones supported by both.
+func (i *PluginInfo) Negotiate(peer *PluginInfo) *PluginInfo {
+	info := *peer
+	if info.ProtoVer < MinProtoVer {
+		info.ProtoVer = MinProtoVer
+	}
+	if info.ProtoVer > i.ProtoVer {
+		info.ProtoVer = i.ProtoVer
+	}
+	if info.ProtoVer < 3 {
+		info.Types = legacyTypes
+	}
+	info.Capabilities = nil
+	for _, c := range peer.Capabilities {
+		if i.Has(c) {
+			info.Capabilities = append(info.Capabilities, c)
+		}
+	}
+	return &info
+}
+
+// CheckRequest asks the plugin to initialize a unit without starting it. The
+// plugin replies TypCheckResult with an error message, or empty if succeeded.
+type CheckRequest struct {
+	Config string          `codec:"config"`
+	Buffer *buffer.Options `codec:"buffer"`
+}
+
+// Stats is the runtime state of the units reported by the plugin.
+type Stats struct {
+	Units []*UnitStats `codec:"units"`
+}
+
+type UnitStats struct {
+	ID int32 `codec:"id"`
+	// Events emitted by input plugins, or passed on by filter plugins
+	Emitted int64 `codec:"emitted"`
+	// Events processed by filter plugins
+	Filtered int64 `codec:"filtered"`
+	// Items written by output plugins
+	Written int64         `codec:"written"`
+	Buffer  *buffer.Stats `codec:"buffer"`
+	// Events received and emitted by the unit, counted by tag prefix
+	EventsIn     map[string]int64 `codec:"events_in"`
+	EventsOut    map[string]int64 `codec:"events_out"`
+	FilterErrors int64            `codec:"filter_errors"`
+	EncodeErrors int64            `codec:"encode_errors"`
+	// Metrics reported by the plugin itself
+	Metrics []*Metric `codec:"metrics"`
+}
+
+// Metric is a gauge reported by plugins. The name is exposed with fluxion_
+// prefix.
+type Metric struct {
+	Name   string            `codec:"name"`
+	Help   string            `codec:"help"`
+	Labels map[string]string `codec:"labels"`
+	Value  float64           `codec:"value"`
 }
 
 var mh = &codec.MsgpackHandle{RawToString: true, WriteExt: true}
@@ -0,0 +1,85 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+)
+
+func encode(t testing.TB, m *Message) []byte {
+	buf := new(bytes.Buffer)
+	if err := m.Encode(NewEncoder(buf)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func FuzzMessageDecode(f *testing.F) {
+	ev := NewEvent("foo", map[string]interface{}{"message": "bar", "n": 1})
+	ev.Origin = &Origin{Unit: 1, Seq: 2}
+	for _, m := range []*Message{
+		{Type: TypInfoResponse, Payload: &PluginInfo{ProtoVer: 3}},
+		{Type: TypBufferOption, Payload: &buffer.Options{Name: "foo"}},
+		{Type: TypConfigure, Payload: "key = 1"},
+		{Type: TypEvent, UnitID: 1, Seq: 3, Payload: ev},
+		{Type: TypEventChain, Payload: ev},
+		{Type: TypEventBatch, Payload: &EventBatch{Seqs: []uint64{1, 2}, Events: []*Event{ev, ev}}},
+		{Type: TypAck, Payload: []Origin{{Unit: 1, Seq: 2}}},
+		{Type: TypHandoff, Payload: []uint64{1, 2, 3}},
+		{Type: TypStdout, Payload: []byte("foo")},
+		{Type: TypProtocolError, Payload: &ProtocolError{Type: TypEvent, Error: "foo"}},
+		{Type: TypStats, Payload: &Stats{Units: []*UnitStats{{ID: 1}}}},
+	} {
+		f.Add(byte(m.Type), encode(f, m))
+	}
+
+	f.Fuzz(func(t *testing.T, typ byte, b []byte) {
+		m := &Message{Type: MessageType(typ)}
+		if err := m.Decode(NewDecoder(bytes.NewReader(b))); err != nil {
+			return
+		}
+		// Decoded messages are valid as much as encodable again
+		if batch, ok := m.Payload.(*EventBatch); ok {
+			for _, ev := range batch.Events {
+				if ev == nil {
+					t.Fatal("nil event in batch")
+				}
+			}
+		}
+		encode(t, m)
+	})
+}
+
+func TestNegotiate(t *testing.T) {
+	engine := &PluginInfo{ProtoVer: ProtoVer, Capabilities: []string{CapBatch, CapAck}}
+
+	info := engine.Negotiate(&PluginInfo{
+		ProtoVer:     ProtoVer + 1,
+		Kind:         KindOutput,
+		Types:        []MessageType{TypEvent, TypEventBatch},
+		Capabilities: []string{CapBatch, CapStats},
+	})
+	assert.Equal(t, ProtoVer, info.ProtoVer)
+	assert.Equal(t, KindOutput, info.Kind)
+	assert.True(t, info.Has(CapBatch))
+	assert.False(t, info.Has(CapStats))
+	assert.False(t, info.Has(CapAck))
+	assert.True(t, info.Accepts(TypEventBatch))
+
+	// Older plugins handle the types existed at the time
+	info = engine.Negotiate(&PluginInfo{ProtoVer: 1})
+	assert.Equal(t, uint8(1), info.ProtoVer)
+	assert.Empty(t, info.Capabilities)
+	assert.True(t, info.Accepts(TypEvent))
+	assert.False(t, info.Accepts(TypEventBatch))
+
+	// Older engines send no info
+	info = info.Negotiate(&PluginInfo{})
+	assert.Equal(t, MinProtoVer, info.ProtoVer)
+
+	var nilInfo *PluginInfo
+	assert.False(t, nilInfo.Has(CapBatch))
+	assert.False(t, nilInfo.Accepts(TypEvent))
+}
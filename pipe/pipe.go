@@ -1,6 +1,11 @@
 package pipe
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"sync"
 
@@ -30,45 +35,165 @@ func (p *InProcess) Write(ev *message.Message) error {
 	return nil
 }
 
+// Messages between processes are sent in frames. A frame starts with a header
+// of the body length, the message type and flags, followed by the body and
+// the CRC-32 of the body if flagChecksum is set.
+const (
+	headerSize   = 6
+	flagChecksum = 1 << 0
+	// Frames longer than this are never written, so the length is broken
+	MaxFrameSize = 64 << 20
+)
+
+// ChecksumEnv is set for plugin processes to checksum frames they write.
+const ChecksumEnv = "FLUXION_PIPE_CHECKSUM"
+
+// ErrCorrupted is returned by Read when the stream can't be synchronized
+// again. The pipe is no longer readable.
+var ErrCorrupted = errors.New("pipe: stream corrupted")
+
+var errChecksum = errors.New("checksum mismatch")
+
+// FrameError is returned by Read when a frame is not decodable. The frame is
+// skipped, and the next Read continues from the following frame.
+type FrameError struct {
+	Type message.MessageType
+	Err  error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("pipe: bad frame of type %d: %v", e.Type, e.Err)
+}
+
 type InterProcess struct {
-	r   io.Reader
-	w   io.Writer
-	enc message.Encoder
-	dec message.Decoder
-	rm  sync.Mutex
-	wm  sync.Mutex
+	r io.Reader
+	w io.Writer
+	// Checksum frames written to the pipe
+	Checksum bool
+	// Protocol versions of both directions, messages are not framed before 3
+	rver   uint8
+	wver   uint8
+	broken bool
+	header [headerSize]byte
+	rbuf   []byte
+	wbuf   bytes.Buffer
+	enc    message.Encoder
+	// Used for the messages not framed
+	dec  message.Decoder
+	lenc message.Encoder
+	rm   sync.Mutex
+	wm   sync.Mutex
 }
 
 func NewInterProcess(r io.Reader, w io.Writer) *InterProcess {
-	p := &InterProcess{}
+	p := &InterProcess{r: r, w: w, rver: message.ProtoVer, wver: message.ProtoVer}
 	if r != nil {
-		p.r = r
 		p.dec = message.NewDecoder(r)
 	}
 	if w != nil {
-		p.w = w
-		p.enc = message.NewEncoder(w)
+		p.enc = message.NewEncoder(&p.wbuf)
+		p.lenc = message.NewEncoder(w)
 	}
 	return p
 }
 
+// SetVersion sets the protocol version of the messages read and written
+// afterwards.
+func (p *InterProcess) SetVersion(ver uint8) {
+	p.rm.Lock()
+	p.rver = ver
+	p.rm.Unlock()
+	p.wm.Lock()
+	p.wver = ver
+	p.wm.Unlock()
+}
+
 func (p *InterProcess) Read() (*message.Message, error) {
 	p.rm.Lock()
 	defer p.rm.Unlock()
+	if p.broken {
+		return nil, ErrCorrupted
+	}
+	if p.rver < 3 {
+		return p.readLegacy()
+	}
+	if _, err := io.ReadFull(p.r, p.header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(p.header[:4])
+	typ, flags := message.MessageType(p.header[4]), p.header[5]
+	if n > MaxFrameSize {
+		p.broken = true
+		return nil, ErrCorrupted
+	}
+	if cap(p.rbuf) < int(n) {
+		p.rbuf = make([]byte, n)
+	}
+	body := p.rbuf[:n]
+	if _, err := io.ReadFull(p.r, body); err != nil {
+		return nil, err
+	}
+
+	if flags&flagChecksum != 0 {
+		if n < 4 {
+			return nil, &FrameError{typ, errChecksum}
+		}
+		sum := binary.BigEndian.Uint32(body[n-4:])
+		if body = body[:n-4]; crc32.ChecksumIEEE(body) != sum {
+			return nil, &FrameError{typ, errChecksum}
+		}
+	}
+	m := &message.Message{Type: typ}
+	if err := m.Decode(message.NewDecoder(bytes.NewReader(body))); err != nil {
+		return nil, &FrameError{typ, err}
+	}
+	return m, nil
+}
+
+// readLegacy reads a message of the type byte followed by the body.
+func (p *InterProcess) readLegacy() (*message.Message, error) {
 	b := make([]byte, 1)
 	if _, err := p.r.Read(b); err != nil {
 		return nil, err
 	}
 	m := &message.Message{Type: message.MessageType(b[0])}
-	m.Decode(p.dec)
+	if err := m.DecodeVersion(p.dec, p.rver); err != nil {
+		// The stream can't be synchronized without frames
+		p.broken = true
+		return nil, ErrCorrupted
+	}
 	return m, nil
 }
 
 func (p *InterProcess) Write(m *message.Message) error {
 	p.wm.Lock()
 	defer p.wm.Unlock()
-	if _, err := p.w.Write([]byte{byte(m.Type)}); err != nil {
+	if p.wver < 3 {
+		if _, err := p.w.Write([]byte{byte(m.Type)}); err != nil {
+			return err
+		}
+		return m.EncodeVersion(p.lenc, p.wver)
+	}
+	p.wbuf.Reset()
+	p.wbuf.Write(make([]byte, headerSize))
+	if err := m.Encode(p.enc); err != nil {
 		return err
 	}
-	return m.Encode(p.enc)
+	var flags byte
+	if p.Checksum {
+		flags |= flagChecksum
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(p.wbuf.Bytes()[headerSize:]))
+		p.wbuf.Write(sum[:])
+	}
+	b := p.wbuf.Bytes()
+	n := len(b) - headerSize
+	if n > MaxFrameSize {
+		return fmt.Errorf("pipe: frame too large: %d bytes", n)
+	}
+	binary.BigEndian.PutUint32(b, uint32(n))
+	b[4], b[5] = byte(m.Type), flags
+	// Written at once, so that a frame is not interleaved with others
+	_, err := p.w.Write(b)
+	return err
 }
@@ -0,0 +1,162 @@
+package pipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/message"
+)
+
+func TestInterProcessFrames(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewInterProcess(nil, buf)
+	r := NewInterProcess(buf, nil)
+	w.Write(&message.Message{Type: message.TypEvent, UnitID: 1, Seq: 2, Payload: newEvent()})
+	w.Checksum = true
+	w.Write(&message.Message{Type: message.TypConfigure, UnitID: 3, Payload: "foo"})
+
+	m, err := r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, message.TypEvent, m.Type)
+	assert.Equal(t, int32(1), m.UnitID)
+	assert.Equal(t, uint64(2), m.Seq)
+	assert.Equal(t, "bench", m.Payload.(*message.Event).Tag)
+	m, err = r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", m.Payload)
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestInterProcessLegacy(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewInterProcess(nil, buf)
+	r := NewInterProcess(buf, nil)
+	w.SetVersion(message.MinProtoVer)
+	r.SetVersion(message.MinProtoVer)
+	w.Write(&message.Message{Type: message.TypInfoRequest})
+	w.Write(&message.Message{Type: message.TypEvent, UnitID: 1, Seq: 2, Payload: newEvent()})
+	// The legacy stream is a type byte followed by the body
+	assert.Equal(t, byte(message.TypInfoRequest), buf.Bytes()[0])
+
+	m, err := r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, message.TypInfoRequest, m.Type)
+	m, err = r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), m.UnitID)
+	assert.Equal(t, uint64(0), m.Seq)
+	assert.Equal(t, "bench", m.Payload.(*message.Event).Tag)
+
+	// Switched to frames after negotiated
+	w.SetVersion(message.ProtoVer)
+	r.SetVersion(message.ProtoVer)
+	w.Write(&message.Message{Type: message.TypEvent, Seq: 3, Payload: newEvent()})
+	m, err = r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), m.Seq)
+}
+
+func TestInterProcessBadFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewInterProcess(nil, buf)
+	r := NewInterProcess(buf, nil)
+	w.Checksum = true
+	w.Write(&message.Message{Type: message.TypConfigure, Payload: "foo"})
+	n := buf.Len()
+	w.Write(&message.Message{Type: message.TypConfigure, Payload: "bar"})
+	w.Write(&message.Message{Type: message.TypConfigure, Payload: "baz"})
+
+	// The corrupted frame is skipped, and the next one is read
+	buf.Bytes()[n+headerSize+1] ^= 0xff
+	m, err := r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", m.Payload)
+	_, err = r.Read()
+	if assert.IsType(t, &FrameError{}, err) {
+		assert.Equal(t, message.TypConfigure, err.(*FrameError).Type)
+		assert.Equal(t, errChecksum, err.(*FrameError).Err)
+	}
+	m, err = r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", m.Payload)
+
+	// Undecodable frames are skipped as well
+	w.Checksum = false
+	w.Write(&message.Message{Type: message.TypEvent, Payload: "foo"})
+	w.Write(&message.Message{Type: message.TypConfigure, Payload: "bar"})
+	_, err = r.Read()
+	assert.IsType(t, &FrameError{}, err)
+	m, err = r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", m.Payload)
+}
+
+func TestInterProcessCorrupted(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewInterProcess(nil, buf)
+	r := NewInterProcess(buf, nil)
+	w.Write(&message.Message{Type: message.TypConfigure, Payload: "foo"})
+	binary.BigEndian.PutUint32(buf.Bytes(), MaxFrameSize+1)
+	w.Write(&message.Message{Type: message.TypConfigure, Payload: "bar"})
+
+	_, err := r.Read()
+	assert.Equal(t, ErrCorrupted, err)
+	_, err = r.Read()
+	assert.Equal(t, ErrCorrupted, err)
+}
+
+func newEvent() *message.Event {
+	return message.NewEvent("bench", map[string]interface{}{
+		"host":    "localhost",
+		"message": "GET /index.html HTTP/1.1",
+		"status":  200,
+	})
+}
+
+// roundTrip writes the messages to the pipe, then reads them back.
+func roundTrip(b *testing.B, msgs []*message.Message) {
+	buf := new(bytes.Buffer)
+	w := NewInterProcess(nil, buf)
+	r := NewInterProcess(buf, nil)
+	for _, m := range msgs {
+		if err := w.Write(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for range msgs {
+		if _, err := r.Read(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInterProcessEvent(b *testing.B) {
+	msgs := make([]*message.Message, message.BatchSize)
+	for i := range msgs {
+		msgs[i] = &message.Message{Type: message.TypEvent, Seq: uint64(i + 1), Payload: newEvent()}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		roundTrip(b, msgs)
+	}
+}
+
+func BenchmarkInterProcessEventBatch(b *testing.B) {
+	batch := &message.EventBatch{
+		Seqs:   make([]uint64, message.BatchSize),
+		Events: make([]*message.Event, message.BatchSize),
+	}
+	for i := range batch.Events {
+		batch.Seqs[i] = uint64(i + 1)
+		batch.Events[i] = newEvent()
+	}
+	msgs := []*message.Message{{Type: message.TypEventBatch, Payload: batch}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		roundTrip(b, msgs)
+	}
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+)
+
+// acks holds callbacks of events emitted by EmitWithAck until all outputs
+// acknowledge them.
+type acks struct {
+	seq       uint64
+	callbacks map[uint64]func()
+	m         sync.Mutex
+}
+
+func newAcks() *acks {
+	// Sequences start from the current time, so that acks for events emitted
+	// by the previous process are not confused with new ones.
+	return &acks{
+		seq:       uint64(time.Now().UnixNano()),
+		callbacks: make(map[uint64]func()),
+	}
+}
+
+func (a *acks) add(f func()) uint64 {
+	seq := atomic.AddUint64(&a.seq, 1)
+	a.m.Lock()
+	a.callbacks[seq] = f
+	a.m.Unlock()
+	return seq
+}
+
+func (a *acks) done(seq uint64) {
+	a.m.Lock()
+	f, ok := a.callbacks[seq]
+	delete(a.callbacks, seq)
+	a.m.Unlock()
+	if ok {
+		f()
+	}
+}
+
+// emitWithAck emits the event, then calls ack after the event is written by
+// all outputs, dropped by a filter or not routed to any output.
+func (u *execUnit) emitWithAck(ev *message.Event, ack func()) {
+	ev.Origin = &message.Origin{Unit: u.ID, Seq: u.acks.add(ack)}
+	u.emitEvent(ev)
+}
+
+// ack tells the engine that the events are delivered.
+func (u *execUnit) ack(origins ...*message.Origin) {
+	var l []message.Origin
+	for _, o := range origins {
+		if o != nil {
+			l = append(l, *o)
+		}
+	}
+	if len(l) > 0 {
+		u.send(&message.Message{Type: message.TypAck, Payload: l})
+	}
+}
+
+// ackItem keeps the origin of the event along with the encoded item, so that
+// the input is acknowledged after the item is written.
+type ackItem struct {
+	buffer.Sizer
+	origin *message.Origin
+	// Sequence of the handoff, 0 if confirmed already
+	seq uint64
+}
+
+func (i *ackItem) Unwrap() buffer.Sizer {
+	return i.Sizer
+}
+
+func (i *ackItem) Wrap(s buffer.Sizer) buffer.Sizer {
+	return &ackItem{s, i.origin, i.seq}
+}
+
+func (i *ackItem) ItemType() byte {
+	return itemAck
+}
+
+func (i *ackItem) MarshalBinary() ([]byte, error) {
+	return marshalItem(i.Sizer, &eventItemData{Origin: i.origin})
+}
+
+// tokens returns the origin and the handoff sequence of the event of the
+// item. They are zero values if not tracked.
+func tokens(s buffer.Sizer) (*message.Origin, uint64) {
+	switch i := s.(type) {
+	case *ackItem:
+		return i.origin, i.seq
+	case *eventItem:
+		return i.ev.Origin, i.seq
+	}
+	return nil, 0
+}
+
+// delivered acknowledges the origin, and confirms the handoff of the event.
+func (u *execUnit) delivered(o *message.Origin, seq uint64) {
+	u.ack(o)
+	u.handoff.confirm(seq)
+}
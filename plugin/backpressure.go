@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+)
+
+// gate blocks events emitted by input plugins while the engine asks to pause.
+// Inputs stop reading their sources since Env.Emit doesn't return.
+type gate struct {
+	c chan struct{} // non-nil while paused
+	m sync.Mutex
+}
+
+func (g *gate) pause() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.c == nil {
+		g.c = make(chan struct{})
+	}
+}
+
+func (g *gate) resume() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.c != nil {
+		close(g.c)
+		g.c = nil
+	}
+}
+
+func (g *gate) wait() {
+	g.m.Lock()
+	c := g.c
+	g.m.Unlock()
+	if c != nil {
+		<-c
+	}
+}
+
+// checkPressure asks the engine to pause inputs if the buffer usage exceeds
+// the high watermark. Inputs are resumed when the usage falls below the low
+// watermark.
+func (u *execUnit) checkPressure(buf buffer.Buffer, opts *buffer.Options) {
+	if buf.Usage() < opts.HighWatermark || !atomic.CompareAndSwapInt32(&u.pressured, 0, 1) {
+		return
+	}
+	u.log.Warningf("Buffer usage exceeds %g, pausing inputs", opts.HighWatermark)
+	u.send(&message.Message{Type: message.TypPause})
+	go func() {
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if buf.Usage() >= opts.LowWatermark {
+					continue
+				}
+			case <-u.doneC:
+				return
+			}
+			atomic.StoreInt32(&u.pressured, 0)
+			u.log.Info("Buffer usage recovered, resuming inputs")
+			u.send(&message.Message{Type: message.TypResume})
+			return
+		}
+	}()
+}
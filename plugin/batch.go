@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+// batcher coalesces events emitted by the plugin into a TypEventBatch, within
+// the limits of message.BatchSize and message.BatchDelay.
+type batcher struct {
+	send   func(*message.Message)
+	events []*message.Event
+	timer  *time.Timer
+	m      sync.Mutex
+	// Held while sending, so that batches keep the order of events
+	sm sync.Mutex
+}
+
+func newBatcher(send func(*message.Message)) *batcher {
+	return &batcher{send: send}
+}
+
+func (b *batcher) add(ev *message.Event) {
+	b.m.Lock()
+	b.events = append(b.events, ev)
+	if len(b.events) == 1 {
+		b.timer = time.AfterFunc(message.BatchDelay, b.flush)
+	}
+	full := len(b.events) >= message.BatchSize
+	b.m.Unlock()
+	if full {
+		b.flush()
+	}
+}
+
+// flush sends the events collected so far.
+func (b *batcher) flush() {
+	b.sm.Lock()
+	defer b.sm.Unlock()
+	b.m.Lock()
+	l := b.events
+	b.events = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.m.Unlock()
+
+	switch len(l) {
+	case 0:
+	case 1:
+		b.send(&message.Message{Type: message.TypEvent, Payload: l[0]})
+	default:
+		b.send(&message.Message{Type: message.TypEventBatch, Payload: &message.EventBatch{Events: l}})
+	}
+}
@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/log"
+	"github.com/yosisa/fluxion/message"
+)
+
+// Check initializes a plugin with the config, without starting it, or calls
+// Check if the plugin is a Checker. Events and logs emitted during
+// initialization are discarded.
+func Check(f PluginFactory, name string, conf string, bopts *buffer.Options) error {
+	discard := func(*message.Event) {}
+	env := &Env{
+		ReadConfig: func(v interface{}) error {
+			_, err := toml.Decode(conf, v)
+			return err
+		},
+		Emit:        discard,
+		EmitWithAck: func(*message.Event, func()) {},
+		Log: &log.Logger{
+			Name:     name,
+			Prefix:   fmt.Sprintf("[check:%s] ", name),
+			EmitFunc: discard,
+		},
+		Buffer: bopts,
+	}
+	p := f()
+	initialize := p.Init
+	if c, ok := p.(Checker); ok {
+		initialize = c.Check
+	}
+	if err := initialize(env); err != nil {
+		return err
+	}
+	if _, ok := p.(OutputPlugin); ok {
+		var oc outputConfig
+		return env.ReadConfig(&oc)
+	}
+	return nil
+}
+
+func (p *plugin) check(m *message.Message) {
+	req := m.Payload.(*message.CheckRequest)
+	var result string
+	if err := Check(p.f, p.name, req.Config, req.Buffer); err != nil {
+		result = err.Error()
+	}
+	p.pipe.Write(&message.Message{
+		Type:    message.TypCheckResult,
+		UnitID:  m.UnitID,
+		Payload: result,
+	})
+}
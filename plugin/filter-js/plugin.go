@@ -23,6 +23,10 @@ type JSFilter struct {
 	script *otto.Script
 }
 
+func (f *JSFilter) ConfigSchema() interface{} {
+	return &Config{}
+}
+
 func (f *JSFilter) Init(env *plugin.Env) (err error) {
 	f.env = env
 	f.conf = &Config{}
@@ -0,0 +1,57 @@
+package filter_js
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin/plugintest"
+)
+
+func TestFilter(t *testing.T) {
+	h := plugintest.New(Factory, `
+script = """
+if ($.event.record.drop) {
+  $.drop();
+} else {
+  $.event.record.env = $.env.name;
+  $.emit("copy." + $.event.tag, {seq: $.event.record.seq});
+}
+"""
+env = {name = "test"}
+`)
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ev, err := h.Filter(message.NewEvent("foo", map[string]interface{}{"seq": 1}))
+	assert.NoError(t, err)
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, "test", ev.Record["env"])
+	}
+	ev, err = h.Filter(message.NewEvent("foo", map[string]interface{}{"drop": true}))
+	assert.NoError(t, err)
+	assert.Nil(t, ev)
+
+	events := h.Events()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "copy.foo", events[0].Tag)
+		assert.EqualValues(t, 1, events[0].Record["seq"])
+	}
+	assert.NoError(t, h.Close())
+}
+
+func TestFilterError(t *testing.T) {
+	h := plugintest.New(Factory, `script = "$.emit('foo', 'not a record'); undefinedFunc();"`)
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := h.Filter(message.NewEvent("foo", nil))
+	assert.Error(t, err)
+	assert.Len(t, h.Events(), 0)
+	assert.Len(t, h.Logs("warning"), 1)
+
+	// Scripts are compiled in Init
+	h = plugintest.New(Factory, `script = "if ("`)
+	assert.Error(t, h.Init())
+}
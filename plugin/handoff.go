@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+const handoffInterval = 100 * time.Millisecond
+
+// handoff collects sequences of events which are safe from the crash of the
+// process, so that the engine forgets them. Events are confirmed when pushed
+// to file buffers, or when written for memory buffers.
+type handoff struct {
+	seqs []uint64
+	m    sync.Mutex
+}
+
+func (h *handoff) confirm(seqs ...uint64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for _, seq := range seqs {
+		if seq != 0 {
+			h.seqs = append(h.seqs, seq)
+		}
+	}
+}
+
+func (h *handoff) take() []uint64 {
+	h.m.Lock()
+	defer h.m.Unlock()
+	seqs := h.seqs
+	h.seqs = nil
+	return seqs
+}
+
+// handoffLoop sends the confirmed sequences to the engine periodically.
+func (u *execUnit) handoffLoop() {
+	if !u.peer.Has(message.CapHandoff) {
+		return
+	}
+	tick := time.NewTicker(handoffInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if seqs := u.handoff.take(); len(seqs) > 0 {
+				u.send(&message.Message{Type: message.TypHandoff, Payload: seqs})
+			}
+		case <-u.doneC:
+			return
+		}
+	}
+}
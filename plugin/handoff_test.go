@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+)
+
+// compressedOutput receives chunks compressed by the buffer.
+type compressedOutput struct {
+	chunks chan *buffer.CompressedItem
+}
+
+func (o *compressedOutput) Init(*Env) error { return nil }
+func (o *compressedOutput) Start() error    { return nil }
+func (o *compressedOutput) Close() error    { return nil }
+
+func (o *compressedOutput) Encode(ev *message.Event) (buffer.Sizer, error) {
+	return buffer.BytesItem(strings.Repeat(ev.Tag, 100)), nil
+}
+
+func (o *compressedOutput) Write(l []buffer.Sizer) (int, error) {
+	return len(l), nil
+}
+
+func (o *compressedOutput) AcceptCompressed(format buffer.Compression) bool {
+	return format == buffer.CompressGzip
+}
+
+func (o *compressedOutput) WriteCompressed(meta *buffer.Metadata, c *buffer.CompressedItem) error {
+	o.chunks <- c
+	return nil
+}
+
+func TestHandoffCompressed(t *testing.T) {
+	out := &compressedOutput{chunks: make(chan *buffer.CompressedItem, 10)}
+	p := pipe.NewInProcess()
+	peer := &message.PluginInfo{ProtoVer: message.ProtoVer, Capabilities: []string{message.CapHandoff}}
+	u := newExecUnit(1, "out-test", out, p, &gate{}, peer)
+
+	bopts := &buffer.Options{FlushMode: buffer.FlushModeImmediate, Compress: buffer.CompressGzip}
+	bopts.SetDefault()
+	u.msgC <- &message.Message{Type: message.TypBufferOption, Payload: bopts}
+	u.msgC <- &message.Message{Type: message.TypConfigure, Payload: ""}
+	u.msgC <- &message.Message{Type: message.TypStart}
+	batch := &message.EventBatch{Seqs: []uint64{1, 2, 3}}
+	for i := range batch.Seqs {
+		ev := message.NewEvent("foo", nil)
+		ev.Origin = &message.Origin{Unit: 5, Seq: uint64(10 + i)}
+		batch.Events = append(batch.Events, ev)
+	}
+	u.msgC <- &message.Message{Type: message.TypEventBatch, Payload: batch}
+
+	// Items are written compressed, then acknowledged and confirmed
+	var written int
+	for written < len(batch.Events) {
+		select {
+		case c := <-out.chunks:
+			assert.Len(t, c.Wrappers, c.Len())
+			written += c.Len()
+		case <-time.After(5 * time.Second):
+			t.Fatal("Compressed chunks are not written")
+		}
+	}
+	var seqs, acked []uint64
+	deadline := time.After(5 * time.Second)
+	for len(seqs) < 3 || len(acked) < 3 {
+		mc := make(chan *message.Message, 1)
+		go func() {
+			m, _ := p.Read()
+			mc <- m
+		}()
+		select {
+		case m := <-mc:
+			switch m.Type {
+			case message.TypHandoff:
+				seqs = append(seqs, m.Payload.([]uint64)...)
+			case message.TypAck:
+				for _, o := range m.Payload.([]message.Origin) {
+					acked = append(acked, o.Seq)
+				}
+			}
+		case <-deadline:
+			t.Fatalf("Not confirmed: handoff %v, ack %v", seqs, acked)
+		}
+	}
+	sort.Sort(uint64s(seqs))
+	sort.Sort(uint64s(acked))
+	assert.Equal(t, []uint64{1, 2, 3}, seqs)
+	assert.Equal(t, []uint64{10, 11, 12}, acked)
+	u.stop()
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -1,9 +1,12 @@
 package in_forward
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"strconv"
@@ -28,6 +31,10 @@ type ForwardInput struct {
 	closed  bool
 }
 
+func (i *ForwardInput) ConfigSchema() interface{} {
+	return &Config{}
+}
+
 func (i *ForwardInput) Init(env *plugin.Env) error {
 	i.env = env
 	i.conf = &Config{}
@@ -97,8 +104,15 @@ func (i *ForwardInput) handleConnection(rw io.ReadWriter) {
 			if isTimeFormat(v[1]) {
 				i.parseFlatEncoding(tag, v)
 			} else {
+				opts := v[2].(map[string]interface{})
+				if opts["compressed"] == "gzip" {
+					if err := decompressEntries(v); err != nil {
+						i.env.Log.Warning(err)
+						continue
+					}
+				}
 				i.parseNestedEncoding(tag, v)
-				i.handleOption(rw, v[2].(map[string]interface{}))
+				i.handleOption(rw, opts)
 			}
 		case 4:
 			i.parseFlatEncoding(tag, v)
@@ -135,6 +149,27 @@ func (i *ForwardInput) parseNestedEncoding(tag string, v []interface{}) {
 	}
 }
 
+// decompressEntries replaces the entries of CompressedPackedForward mode with
+// the decompressed ones.
+func decompressEntries(v []interface{}) error {
+	var b []byte
+	switch typed := v[1].(type) {
+	case []byte:
+		b = typed
+	case string:
+		b = []byte(typed)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if v[1], err = ioutil.ReadAll(r); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (i *ForwardInput) parseFlatEncoding(tag string, v []interface{}) {
 	t, err := parseTime(v[1])
 	if err != nil {
@@ -2,13 +2,14 @@ package in_forward
 
 import (
 	"bytes"
+	"compress/gzip"
 	"io/ioutil"
 	"testing"
 	"time"
 
 	"github.com/ugorji/go/codec"
 	"github.com/yosisa/fluxion/message"
-	"github.com/yosisa/fluxion/plugin"
+	"github.com/yosisa/fluxion/plugin/plugintest"
 	. "gopkg.in/check.v1"
 )
 
@@ -35,33 +36,32 @@ func (rw *rwBuffer) Write(b []byte) (int, error) {
 func Test(t *testing.T) { TestingT(t) }
 
 type HandleConnection struct {
-	events []*message.Event
-	buf    *rwBuffer
-	enc    *codec.Encoder
-	p      *ForwardInput
+	h   *plugintest.Harness
+	buf *rwBuffer
+	enc *codec.Encoder
+	p   *ForwardInput
 }
 
 var _ = Suite(&HandleConnection{})
 
 func (s *HandleConnection) SetUpTest(c *C) {
-	s.events = nil
 	s.buf = newRWBuffer()
 	s.enc = codec.NewEncoder(s.buf.r, mh)
-	s.p = &ForwardInput{
-		env: &plugin.Env{
-			Emit: func(ev *message.Event) {
-				s.events = append(s.events, ev)
-			},
-		},
-	}
+	s.h = plugintest.New(Factory, `bind = "127.0.0.1:0"`)
+	c.Assert(s.h.Init(), IsNil)
+	s.p = s.h.Plugin.(*ForwardInput)
+}
+
+func (s *HandleConnection) events() []*message.Event {
+	return s.h.Events()
 }
 
 func (s *HandleConnection) TestFlatEncoding(c *C) {
 	t := time.Now().UTC()
 	s.enc.Encode([]interface{}{"flat", t, map[string]interface{}{"key": "value"}})
 	s.p.handleConnection(s.buf)
-	c.Assert(len(s.events), Equals, 1)
-	ev := s.events[0]
+	c.Assert(len(s.events()), Equals, 1)
+	ev := s.events()[0]
 	c.Assert(ev.Tag, Equals, "flat")
 	c.Assert(ev.Time, Equals, t)
 	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"key": "value"})
@@ -76,13 +76,13 @@ func (s *HandleConnection) TestNestedEncoding(c *C) {
 	enc.Encode([]interface{}{t2, map[string]interface{}{"seq": 2}})
 	s.enc.Encode([]interface{}{"nested", b.Bytes()})
 	s.p.handleConnection(s.buf)
-	c.Assert(len(s.events), Equals, 2)
+	c.Assert(len(s.events()), Equals, 2)
 
-	ev := s.events[0]
+	ev := s.events()[0]
 	c.Assert(ev.Tag, Equals, "nested")
 	c.Assert(ev.Time, Equals, t1)
 	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"seq": int64(1)})
-	ev = s.events[1]
+	ev = s.events()[1]
 	c.Assert(ev.Tag, Equals, "nested")
 	c.Assert(ev.Time, Equals, t2)
 	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"seq": int64(2)})
@@ -93,8 +93,8 @@ func (s *HandleConnection) TestExtendedFlatEncoding(c *C) {
 	opts := map[string]interface{}{"chunk": 1}
 	s.enc.Encode([]interface{}{"flat-ex", t, map[string]interface{}{"key": "value"}, opts})
 	s.p.handleConnection(s.buf)
-	c.Assert(len(s.events), Equals, 1)
-	ev := s.events[0]
+	c.Assert(len(s.events()), Equals, 1)
+	ev := s.events()[0]
 	c.Assert(ev.Tag, Equals, "flat-ex")
 	c.Assert(ev.Time, Equals, t)
 	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"key": "value"})
@@ -112,13 +112,13 @@ func (s *HandleConnection) TestExtendedNestedEncoding(c *C) {
 	opts := map[string]interface{}{"chunk": 1}
 	s.enc.Encode([]interface{}{"nested-ex", b.Bytes(), opts})
 	s.p.handleConnection(s.buf)
-	c.Assert(len(s.events), Equals, 2)
+	c.Assert(len(s.events()), Equals, 2)
 
-	ev := s.events[0]
+	ev := s.events()[0]
 	c.Assert(ev.Tag, Equals, "nested-ex")
 	c.Assert(ev.Time, Equals, t1)
 	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"seq": int64(1)})
-	ev = s.events[1]
+	ev = s.events()[1]
 	c.Assert(ev.Tag, Equals, "nested-ex")
 	c.Assert(ev.Time, Equals, t2)
 	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"seq": int64(2)})
@@ -126,6 +126,32 @@ func (s *HandleConnection) TestExtendedNestedEncoding(c *C) {
 	c.Assert(resp, DeepEquals, []byte{0x81, 0xa3, 'a', 'c', 'k', 0x01})
 }
 
+func (s *HandleConnection) TestCompressedNestedEncoding(c *C) {
+	t1 := time.Now().UTC()
+	t2 := t1.Add(time.Second)
+	b := new(bytes.Buffer)
+	zw := gzip.NewWriter(b)
+	enc := codec.NewEncoder(zw, mh)
+	enc.Encode([]interface{}{t1, map[string]interface{}{"seq": 1}})
+	enc.Encode([]interface{}{t2, map[string]interface{}{"seq": 2}})
+	c.Assert(zw.Close(), IsNil)
+	opts := map[string]interface{}{"compressed": "gzip", "size": 2, "chunk": 1}
+	s.enc.Encode([]interface{}{"nested-gz", b.Bytes(), opts})
+	s.p.handleConnection(s.buf)
+	c.Assert(len(s.events()), Equals, 2)
+
+	ev := s.events()[0]
+	c.Assert(ev.Tag, Equals, "nested-gz")
+	c.Assert(ev.Time, Equals, t1)
+	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"seq": int64(1)})
+	ev = s.events()[1]
+	c.Assert(ev.Tag, Equals, "nested-gz")
+	c.Assert(ev.Time, Equals, t2)
+	c.Assert(ev.Record, DeepEquals, map[string]interface{}{"seq": int64(2)})
+	resp, _ := ioutil.ReadAll(s.buf.w)
+	c.Assert(resp, DeepEquals, []byte{0x81, 0xa3, 'a', 'c', 'k', 0x01})
+}
+
 type Time struct{}
 
 var _ = Suite(&Time{})
@@ -0,0 +1,98 @@
+package in_tail
+
+import (
+	"sync"
+	"time"
+)
+
+// Lines in flight are limited, reading is paused until some of them are
+// acknowledged.
+const maxPendingLines = 10000
+
+type pendingLine struct {
+	end   int64
+	acked bool
+	at    time.Time
+}
+
+// ackTracker commits the position of the file only up to the lines whose
+// events are acknowledged by outputs. Lines are acknowledged out of order, so
+// the position advances to the end of the highest contiguous acked line.
+type ackTracker struct {
+	pe      *PositionEntry
+	lines   []*pendingLine
+	gen     int
+	timeout time.Duration
+	limit   int
+	// Notified when the lines in flight go below the limit
+	roomC chan struct{}
+	m     sync.Mutex
+}
+
+func newAckTracker(pe *PositionEntry, timeout time.Duration) *ackTracker {
+	return &ackTracker{
+		pe:      pe,
+		timeout: timeout,
+		limit:   maxPendingLines,
+		roomC:   make(chan struct{}, 1),
+	}
+}
+
+// add tracks the line ending at the offset, and returns the function to
+// acknowledge it.
+func (t *ackTracker) add(end int64) func() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	l := &pendingLine{end: end, at: time.Now()}
+	t.lines = append(t.lines, l)
+	gen := t.gen
+	return func() { t.ack(gen, l) }
+}
+
+func (t *ackTracker) ack(gen int, l *pendingLine) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if gen != t.gen {
+		// Acknowledged after the file was reopened
+		return
+	}
+	l.acked = true
+	var n int
+	for n < len(t.lines) && t.lines[n].acked {
+		n++
+	}
+	if n > 0 {
+		full := len(t.lines) >= t.limit
+		t.pe.SetPos(t.lines[n-1].end)
+		t.lines = t.lines[n:]
+		if full {
+			select {
+			case t.roomC <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// full reports whether the lines in flight reach the limit.
+func (t *ackTracker) full() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return len(t.lines) >= t.limit
+}
+
+// reset forgets the lines in flight, acks for them are ignored afterwards.
+func (t *ackTracker) reset() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.gen++
+	t.lines = nil
+}
+
+// expired reports whether the oldest line is not acknowledged within the
+// timeout. It's always false if the timeout is disabled by a negative value.
+func (t *ackTracker) expired(now time.Time) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.timeout > 0 && len(t.lines) > 0 && now.Sub(t.lines[0].at) > t.timeout
+}
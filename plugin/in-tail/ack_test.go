@@ -0,0 +1,78 @@
+package in_tail
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAckTracker(t *testing.T) {
+	posfileName, posfile := tempfile(t)
+	posfile.Close()
+	defer os.Remove(posfileName)
+	pf, err := NewPositionFile(posfileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe := pf.Get("/tmp/foo")
+
+	tr := newAckTracker(pe, time.Minute)
+	ack1 := tr.add(4)
+	ack2 := tr.add(8)
+	ack3 := tr.add(12)
+
+	ack2()
+	if pe.Pos != 0 {
+		t.Fatalf("Invalid position: expected 0 but %d", pe.Pos)
+	}
+	ack1()
+	if pe.Pos != 8 {
+		t.Fatalf("Invalid position: expected 8 but %d", pe.Pos)
+	}
+	if !tr.expired(time.Now().Add(2 * time.Minute)) {
+		t.Fatal("Expected the line to be expired")
+	}
+
+	// Acks before reset are ignored
+	tr.reset()
+	ack3()
+	if pe.Pos != 8 {
+		t.Fatalf("Invalid position: expected 8 but %d", pe.Pos)
+	}
+	if tr.expired(time.Now().Add(2 * time.Minute)) {
+		t.Fatal("Expected no line in flight")
+	}
+
+	tr.add(16)()
+	if pe.Pos != 16 {
+		t.Fatalf("Invalid position: expected 16 but %d", pe.Pos)
+	}
+}
+
+func TestAckTrackerLimit(t *testing.T) {
+	posfileName, posfile := tempfile(t)
+	posfile.Close()
+	defer os.Remove(posfileName)
+	pf, err := NewPositionFile(posfileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe := pf.Get("/tmp/foo")
+
+	tr := newAckTracker(pe, time.Minute)
+	tr.limit = 2
+	ack1 := tr.add(4)
+	tr.add(8)
+	if !tr.full() {
+		t.Fatal("Expected the tracker to be full")
+	}
+	ack1()
+	if tr.full() {
+		t.Fatal("Expected a room for a line")
+	}
+	select {
+	case <-tr.roomC:
+	default:
+		t.Fatal("Expected the room to be notified")
+	}
+}
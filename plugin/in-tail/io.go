@@ -13,6 +13,8 @@ type PositionReader struct {
 	pe  *PositionEntry
 	buf []byte
 	err error
+	// If true, the position is committed by the caller instead of ReadLine
+	deferCommit bool
 }
 
 func NewPositionReader(pe *PositionEntry) (*PositionReader, error) {
@@ -58,7 +60,9 @@ func (r *PositionReader) ReadLine() ([]byte, error) {
 		}
 		r.err = err
 
-		r.pe.SetPos(r.pos)
+		if !r.deferCommit {
+			r.pe.SetPos(r.pos)
+		}
 		if n >= 2 && line[n-2] == '\r' {
 			line = line[:n-2]
 		} else {
@@ -75,6 +79,11 @@ func (r *PositionReader) ReadLine() ([]byte, error) {
 	}
 }
 
+// Pos returns the offset next to the last line read.
+func (r *PositionReader) Pos() int64 {
+	return r.pos
+}
+
 func (r *PositionReader) Close() error {
 	return r.f.Close()
 }
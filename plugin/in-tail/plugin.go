@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/yosisa/fluxion/buffer"
 	"github.com/yosisa/fluxion/message"
 	"github.com/yosisa/fluxion/parser"
 	"github.com/yosisa/fluxion/plugin"
@@ -26,6 +27,11 @@ type Config struct {
 	RecordKey    string `toml:"record_key"`
 	RecordFormat string `toml:"record_format"`
 	ReadFromHead bool   `toml:"read_from_head"`
+	// If true, the position is committed after outputs write the events.
+	// Lines not acknowledged within ack_timeout are read again, it defaults
+	// to 60s and a negative value disables it.
+	Ack        bool            `toml:"ack"`
+	AckTimeout buffer.Duration `toml:"ack_timeout"`
 }
 
 type TailInput struct {
@@ -37,9 +43,30 @@ type TailInput struct {
 	pf         *PositionFile
 	fsw        *fsnotify.Watcher
 	watchers   map[string]*Watcher
+	m          sync.Mutex
+}
+
+func (i *TailInput) ConfigSchema() interface{} {
+	return &Config{}
 }
 
 func (i *TailInput) Init(env *plugin.Env) (err error) {
+	if err = i.Check(env); err != nil {
+		return
+	}
+	pf, ok := posFiles[i.conf.PosFile]
+	if !ok {
+		if pf, err = NewPositionFile(i.conf.PosFile); err != nil {
+			return
+		}
+		posFiles[i.conf.PosFile] = pf
+	}
+	i.pf = pf
+	return
+}
+
+// Check reads the config without opening the position file.
+func (i *TailInput) Check(env *plugin.Env) (err error) {
 	i.env = env
 	i.conf = &Config{}
 	i.watchers = make(map[string]*Watcher)
@@ -49,24 +76,16 @@ func (i *TailInput) Init(env *plugin.Env) (err error) {
 	if i.conf.TimeKey == "" {
 		i.conf.TimeKey = "time"
 	}
+	if i.conf.AckTimeout == 0 {
+		i.conf.AckTimeout = buffer.Duration(60 * time.Second)
+	}
 	i.parser, i.timeParser, err = parser.Get(i.conf.Format, i.conf.TimeFormat, i.conf.TimeZone)
 	if err != nil {
 		return
 	}
 	if i.conf.RecordKey != "" {
-		if i.rparser, _, err = parser.Get(i.conf.RecordFormat, "", ""); err != nil {
-			return
-		}
+		i.rparser, _, err = parser.Get(i.conf.RecordFormat, "", "")
 	}
-
-	pf, ok := posFiles[i.conf.PosFile]
-	if !ok {
-		if pf, err = NewPositionFile(i.conf.PosFile); err != nil {
-			return
-		}
-		posFiles[i.conf.PosFile] = pf
-	}
-	i.pf = pf
 	return
 }
 
@@ -91,7 +110,10 @@ func (i *TailInput) fsEventHandler() {
 			if !ok {
 				return
 			}
-			if w, ok := i.watchers[ev.Name]; ok {
+			i.m.Lock()
+			w, ok := i.watchers[ev.Name]
+			i.m.Unlock()
+			if ok {
 				select {
 				case w.FSEventC <- ev:
 				default:
@@ -117,6 +139,7 @@ func (i *TailInput) pathWatcher() {
 			return
 		}
 
+		i.m.Lock()
 		changes := make(map[string]bool)
 		for f := range i.watchers {
 			changes[f] = false
@@ -144,7 +167,11 @@ func (i *TailInput) pathWatcher() {
 					rkey:       i.conf.RecordKey,
 					rparser:    i.rparser,
 				}
-				i.watchers[f] = NewWatcher(pe, i.env, lp.parseLine, i.fsw)
+				var acks *ackTracker
+				if i.conf.Ack {
+					acks = newAckTracker(pe, time.Duration(i.conf.AckTimeout))
+				}
+				i.watchers[f] = NewWatcher(pe, i.env, lp.parseLine, i.fsw, acks)
 				i.fsw.Add(f)
 			} else {
 				i.env.Log.Info("Stop watching file: ", f)
@@ -153,11 +180,28 @@ func (i *TailInput) pathWatcher() {
 				delete(i.watchers, f)
 			}
 		}
+		i.m.Unlock()
 
 		<-tick
 	}
 }
 
+// Metrics reports the bytes not read yet for each file.
+func (i *TailInput) Metrics() []*message.Metric {
+	i.m.Lock()
+	defer i.m.Unlock()
+	var metrics []*message.Metric
+	for path, w := range i.watchers {
+		metrics = append(metrics, &message.Metric{
+			Name:   "tail_lag_bytes",
+			Help:   "Bytes of the file not read yet.",
+			Labels: map[string]string{"path": path},
+			Value:  float64(w.pe.Lag()),
+		})
+	}
+	return metrics
+}
+
 func realTag(tag, path string) string {
 	if !strings.Contains(tag, "*") {
 		return tag
@@ -176,14 +220,18 @@ type LineParser struct {
 	rparser    parser.Parser
 }
 
-func (l *LineParser) parseLine(b []byte) {
+func (l *LineParser) parseLine(b []byte, ack func()) {
 	line := string(b)
 	v, err := l.parser.Parse(line)
 	if err != nil {
 		l.env.Log.Warningf("Line parser failed: %v, use default parser: %s", err, line)
 		v, _ = parser.DefaultParser.Parse(line)
 	}
-	l.env.Emit(l.makeEvent(v))
+	if ack != nil {
+		l.env.EmitWithAck(l.makeEvent(v), ack)
+	} else {
+		l.env.Emit(l.makeEvent(v))
+	}
 }
 
 func (l *LineParser) makeEvent(v map[string]interface{}) *message.Event {
@@ -212,13 +260,16 @@ func (l *LineParser) makeEvent(v map[string]interface{}) *message.Event {
 	return message.NewEvent(l.tag, v)
 }
 
-type TailHandler func([]byte)
+// TailHandler handles a line. ack is non-nil if the line must be
+// acknowledged to commit the position.
+type TailHandler func(line []byte, ack func())
 
 type Watcher struct {
 	pe       *PositionEntry
 	fsw      *fsnotify.Watcher
 	r        *PositionReader
 	handler  TailHandler
+	acks     *ackTracker
 	rotating bool
 	m        sync.Mutex
 	FSEventC chan fsnotify.Event
@@ -226,11 +277,12 @@ type Watcher struct {
 	env      *plugin.Env
 }
 
-func NewWatcher(pe *PositionEntry, env *plugin.Env, h TailHandler, fsw *fsnotify.Watcher) *Watcher {
+func NewWatcher(pe *PositionEntry, env *plugin.Env, h TailHandler, fsw *fsnotify.Watcher, acks *ackTracker) *Watcher {
 	w := &Watcher{
 		pe:       pe,
 		fsw:      fsw,
 		handler:  h,
+		acks:     acks,
 		FSEventC: make(chan fsnotify.Event, 100),
 		notifyC:  make(chan bool, 1),
 		env:      env,
@@ -253,11 +305,16 @@ func (w *Watcher) open() {
 	if w.r != nil {
 		w.r.Close()
 	}
+	if w.acks != nil {
+		// Lines in flight are read again from the committed position
+		w.acks.reset()
+	}
 
 	r, err := NewPositionReader(w.pe)
 	if err != nil {
 		w.env.Log.Warning(err, ", wait for creation")
 	} else {
+		r.deferCommit = w.acks != nil
 		w.r = r
 		w.fsw.Add(w.pe.Path)
 	}
@@ -266,17 +323,27 @@ func (w *Watcher) open() {
 
 func (w *Watcher) eventLoop() {
 	tick := time.Tick(10 * time.Second)
+	var roomC <-chan struct{}
+	if w.acks != nil {
+		roomC = w.acks.roomC
+	}
 	for {
 		select {
 		case _, ok := <-w.notifyC:
 			if !ok {
 				return
 			}
+		case <-roomC:
 		case ev := <-w.FSEventC:
 			if ev.Op&fsnotify.Create == 0 && ev.Op&fsnotify.Write == 0 {
 				continue
 			}
 		case <-tick:
+			if w.acks != nil && w.acks.expired(time.Now()) {
+				w.env.Log.Warningf("Ack timed out, read again from the committed position: %s", w.pe.Path)
+				w.open()
+				continue
+			}
 		}
 
 		if err := w.Scan(); err != nil {
@@ -293,6 +360,9 @@ func (w *Watcher) Scan() error {
 
 	if !w.rotating {
 		rotated, truncated := w.pe.IsRotated()
+		if truncated && w.acks != nil {
+			w.acks.reset()
+		}
 		if rotated {
 			w.env.Log.Infof("Rotation detected: %s", w.pe.Path)
 			var wait time.Duration
@@ -314,6 +384,10 @@ func (w *Watcher) Scan() error {
 	}
 
 	for {
+		if w.acks != nil && w.acks.full() {
+			// Resumed when some lines are acknowledged
+			return nil
+		}
 		line, err := w.r.ReadLine()
 		if err != nil {
 			if err == io.EOF {
@@ -321,9 +395,12 @@ func (w *Watcher) Scan() error {
 			}
 			return err
 		}
-		w.handler(line)
+		var ack func()
+		if w.acks != nil {
+			ack = w.acks.add(w.r.Pos())
+		}
+		w.handler(line, ack)
 	}
-	return nil
 }
 
 func (w *Watcher) notify() {
@@ -0,0 +1,86 @@
+package in_tail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yosisa/fluxion/plugin"
+	"github.com/yosisa/fluxion/plugin/plugintest"
+)
+
+func TestTail(t *testing.T) {
+	name, f := tempfile(t)
+	defer os.Remove(name)
+	defer f.Close()
+	posfileName, posfile := tempfile(t)
+	posfile.Close()
+	defer os.Remove(posfileName)
+	f.WriteString(`{"seq": 1}` + "\n" + `{"seq": 2}` + "\n")
+
+	h := plugintest.New(Factory, `
+tag = "test"
+path = "`+name+`"
+pos_file = "`+posfileName+`"
+format = "json"
+read_from_head = true
+ack = true
+`)
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if !h.WaitEvents(2, 5*time.Second) {
+		t.Fatalf("Expected 2 events, but %d", len(h.Events()))
+	}
+	f.WriteString(`{"seq": 3}` + "\n")
+	if !h.WaitEvents(3, 5*time.Second) {
+		t.Fatalf("Expected 3 events, but %d", len(h.Events()))
+	}
+	for i, ev := range h.Events() {
+		if ev.Tag != "test" {
+			t.Fatalf("Invalid tag: %s", ev.Tag)
+		}
+		if seq := ev.Record["seq"]; seq != float64(i+1) {
+			t.Fatalf("Invalid record: expected seq %d but %v", i+1, seq)
+		}
+	}
+	if n := h.Ack(); n != 3 {
+		t.Fatalf("Expected 3 acks, but %d", n)
+	}
+	if l := h.Logs("warning"); len(l) > 0 {
+		t.Fatalf("Unexpected warnings: %v", l)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluxion-in-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	posfileName := filepath.Join(dir, "pos")
+
+	conf := func(format string) string {
+		return `
+tag = "test"
+path = "/var/log/*.log"
+pos_file = "` + posfileName + `"
+format = "` + format + `"
+`
+	}
+	if err := plugin.Check(Factory, "in-tail", conf("json"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(posfileName); !os.IsNotExist(err) {
+		t.Fatalf("Position file created by check: %v", err)
+	}
+	if err := plugin.Check(Factory, "in-tail", conf("("), nil); err == nil {
+		t.Fatal("Expected an error for the invalid format")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -30,11 +31,13 @@ func (p *PositionEntry) Refresh() int64 {
 
 	if stat.Ino == p.Ino {
 		// The file previously handled by in-tail.
-		if size < p.Pos {
+		pos := atomic.LoadInt64(&p.Pos)
+		if size < pos {
 			// Maybe truncated
 			p.SetPos(0)
+			return 0
 		}
-		return p.Pos
+		return pos
 	} else if p.Ino != 0 {
 		// The file was rotated, safe to read from head of new file.
 		p.Set(0, stat.Ino)
@@ -56,24 +59,39 @@ func (p *PositionEntry) IsRotated() (rotated, truncated bool) {
 		return
 	}
 	stat := fi.Sys().(*syscall.Stat_t)
-	truncated = fi.Size() < p.Pos
+	truncated = fi.Size() < atomic.LoadInt64(&p.Pos)
 	if truncated {
 		p.SetPos(0)
 	}
 	return stat.Ino != p.Ino, truncated
 }
 
+// Set updates the position. Pos is stored atomically, since Lag and acks of
+// events access it from other goroutines.
 func (p *PositionEntry) Set(pos int64, ino uint64) {
-	p.Pos = pos
+	atomic.StoreInt64(&p.Pos, pos)
 	p.Ino = ino
 	p.pf.set(p.Offset, pos, ino)
 }
 
 func (p *PositionEntry) SetPos(pos int64) {
-	p.Pos = pos
+	atomic.StoreInt64(&p.Pos, pos)
 	p.pf.setPos(p.Offset, pos)
 }
 
+// Lag returns the size of the file minus the position read.
+func (p *PositionEntry) Lag() int64 {
+	fi, err := os.Stat(p.Path)
+	if err != nil {
+		return 0
+	}
+	lag := fi.Size() - atomic.LoadInt64(&p.Pos)
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
 type PositionFile struct {
 	f       *os.File
 	entries map[string]*PositionEntry
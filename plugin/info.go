@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"encoding"
+	"reflect"
+	"strings"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+// ConfigSchema is optionally implemented by plugins to describe their config
+// to the engine. It returns a value of the type decoded by Env.ReadConfig.
+type ConfigSchema interface {
+	ConfigSchema() interface{}
+}
+
+// Message types handled by plugins of this version
+var handledTypes = []message.MessageType{
+	message.TypInfoRequest,
+	message.TypBufferOption,
+	message.TypConfigure,
+	message.TypStart,
+	message.TypStop,
+	message.TypEvent,
+	message.TypEventBatch,
+	message.TypStopUnit,
+	message.TypCheck,
+	message.TypStatsRequest,
+	message.TypAck,
+	message.TypPause,
+	message.TypResume,
+}
+
+var capabilities = []string{
+	message.CapBatch,
+	message.CapAck,
+	message.CapHandoff,
+	message.CapStats,
+	message.CapPause,
+	message.CapCompress,
+	message.CapCheck,
+	message.CapFail,
+}
+
+// Info describes the plugin created by the factory.
+func Info(f PluginFactory) *message.PluginInfo {
+	info := &message.PluginInfo{
+		ProtoVer:     message.ProtoVer,
+		Types:        handledTypes,
+		Capabilities: capabilities,
+	}
+	p := f()
+	switch p.(type) {
+	case nil:
+	case OutputPlugin:
+		info.Kind = message.KindOutput
+	case FilterPlugin:
+		info.Kind = message.KindFilter
+	default:
+		info.Kind = message.KindInput
+	}
+	if s, ok := p.(ConfigSchema); ok {
+		info.Config = configFields(reflect.TypeOf(s.ConfigSchema()))
+		if info.Kind == message.KindOutput {
+			// Handled by the framework
+			info.Config = append(info.Config, configFields(reflect.TypeOf(outputConfig{}))...)
+		}
+	}
+	return info
+}
+
+// configFields lists the keys of the struct as decoded by toml.
+func configFields(t reflect.Type) []*message.ConfigField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []*message.ConfigField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("toml")
+		if n := strings.IndexByte(name, ','); n >= 0 {
+			name = name[:n]
+		}
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			fields = append(fields, configFields(f.Type)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, &message.ConfigField{Name: name, Type: typeName(f.Type)})
+	}
+	return fields
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func typeName(t reflect.Type) string {
+	if reflect.PtrTo(t).Implements(textUnmarshaler) {
+		return "string"
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "table"
+	}
+	return t.Kind().String()
+}
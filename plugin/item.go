@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+)
+
+const (
+	itemEvent = 'e'
+	itemAck   = 'a'
+)
+
+// eventItem keeps the original event along with the encoded item, so that
+// the event can be passed to the secondary output when the item is given up.
+type eventItem struct {
+	buffer.Sizer
+	ev  *message.Event
+	seq uint64
+}
+
+type eventItemData struct {
+	Data   []byte          `codec:"data"`
+	String bool            `codec:"string"`
+	Event  *message.Event  `codec:"event"`
+	Origin *message.Origin `codec:"origin"`
+}
+
+func (i *eventItem) Unwrap() buffer.Sizer {
+	return i.Sizer
+}
+
+func (i *eventItem) Wrap(s buffer.Sizer) buffer.Sizer {
+	return &eventItem{s, i.ev, i.seq}
+}
+
+func (i *eventItem) ItemType() byte {
+	return itemEvent
+}
+
+func (i *eventItem) MarshalBinary() ([]byte, error) {
+	return marshalItem(i.Sizer, &eventItemData{Event: i.ev})
+}
+
+func marshalItem(s buffer.Sizer, d *eventItemData) ([]byte, error) {
+	switch v := s.(type) {
+	case buffer.BytesItem:
+		d.Data = v
+	case buffer.StringItem:
+		d.Data = []byte(v)
+		d.String = true
+	default:
+		return nil, fmt.Errorf("Unsupported item type: %T", s)
+	}
+	b := new(bytes.Buffer)
+	err := message.NewEncoder(b).Encode(d)
+	return b.Bytes(), err
+}
+
+func unmarshalItem(b []byte) (buffer.Sizer, *eventItemData, error) {
+	var d eventItemData
+	if err := message.NewDecoder(bytes.NewReader(b)).Decode(&d); err != nil {
+		return nil, nil, err
+	}
+	if d.String {
+		return buffer.StringItem(d.Data), &d, nil
+	}
+	return buffer.BytesItem(d.Data), &d, nil
+}
+
+func decodeEventItem(b []byte) (buffer.Sizer, error) {
+	s, d, err := unmarshalItem(b)
+	if err != nil {
+		return nil, err
+	}
+	return &eventItem{s, d.Event, 0}, nil
+}
+
+func decodeAckItem(b []byte) (buffer.Sizer, error) {
+	s, d, err := unmarshalItem(b)
+	if err != nil {
+		return nil, err
+	}
+	return &ackItem{s, d.Origin, 0}, nil
+}
+
+// outputHandler writes buffered items with the output plugin.
+type outputHandler struct {
+	u  *execUnit
+	op OutputPlugin
+}
+
+func (h *outputHandler) Write(l []buffer.Sizer) (int, error) {
+	return h.WriteWithMetadata(nil, l)
+}
+
+func (h *outputHandler) WriteWithMetadata(meta *buffer.Metadata, l []buffer.Sizer) (int, error) {
+	items := make([]buffer.Sizer, len(l))
+	for i, s := range l {
+		switch typed := s.(type) {
+		case *eventItem:
+			s = typed.Sizer
+		case *ackItem:
+			s = typed.Sizer
+		}
+		items[i] = s
+	}
+	var n int
+	var err error
+	if w, ok := h.op.(ChunkWriter); ok {
+		n, err = w.WriteChunk(meta, items)
+	} else {
+		n, err = h.op.Write(items)
+	}
+	atomic.AddInt64(&h.u.written, int64(n))
+	if n > 0 {
+		h.ack(l[:n])
+	}
+	return n, err
+}
+
+func (h *outputHandler) ack(l []buffer.Sizer) {
+	origins := make([]*message.Origin, len(l))
+	for i, s := range l {
+		var seq uint64
+		origins[i], seq = tokens(s)
+		h.u.handoff.confirm(seq)
+	}
+	h.u.ack(origins...)
+}
+
+func (h *outputHandler) AcceptCompressed(format buffer.Compression) bool {
+	w, ok := h.op.(CompressedWriter)
+	return ok && w.AcceptCompressed(format)
+}
+
+func (h *outputHandler) WriteCompressed(meta *buffer.Metadata, c *buffer.CompressedItem) error {
+	err := h.op.(CompressedWriter).WriteCompressed(meta, c)
+	if err == nil {
+		atomic.AddInt64(&h.u.written, int64(c.Len()))
+		h.ack(c.Wrappers)
+	}
+	return err
+}
+
+// Discard sends the events of given up items to the secondary output.
+// Dropped items are acknowledged, otherwise their inputs wait forever.
+func (h *outputHandler) Discard(l []buffer.Sizer) (dropped int) {
+	for _, s := range l {
+		ei, ok := s.(*eventItem)
+		if !ok || !h.u.secondary {
+			h.u.delivered(tokens(s))
+			dropped++
+			continue
+		}
+		h.u.send(&message.Message{Type: message.TypEventSecondary, Payload: ei.ev})
+		h.u.handoff.confirm(ei.seq)
+	}
+	return
+}
+
+// Dropped acknowledges items dropped by the overflow action.
+func (h *outputHandler) Dropped(l []buffer.Sizer) {
+	h.ack(l)
+}
+
+func init() {
+	buffer.RegisterItem(itemEvent, decodeEventItem)
+	buffer.RegisterItem(itemAck, decodeAckItem)
+}
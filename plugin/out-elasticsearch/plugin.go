@@ -35,6 +35,10 @@ type ElasticsearchOutput struct {
 	utc    *time.Location
 }
 
+func (o *ElasticsearchOutput) ConfigSchema() interface{} {
+	return &Config{}
+}
+
 func (o *ElasticsearchOutput) Init(env *plugin.Env) error {
 	o.env = env
 	o.conf = &Config{}
@@ -62,14 +66,19 @@ func (o *ElasticsearchOutput) Start() error {
 func (o *ElasticsearchOutput) Encode(ev *message.Event) (buffer.Sizer, error) {
 	index := o.conf.IndexName
 
+	record := ev.Record
+	if o.conf.LogstashFormat || o.conf.TagKey != "" {
+		// The record can be shared with other outputs, fields are added to a copy
+		record = ev.Copy().Record
+	}
 	if o.conf.LogstashFormat {
-		if _, ok := ev.Record["@timestamp"]; !ok {
-			ev.Record["@timestamp"] = ev.Time.Format("2006-01-02T15:04:05.000-07:00")
+		if _, ok := record["@timestamp"]; !ok {
+			record["@timestamp"] = ev.Time.Format("2006-01-02T15:04:05.000-07:00")
 		}
 		index = ev.Time.In(o.utc).Format(o.conf.LogstashPrefix + "-" + o.conf.LogstashDateFormat)
 	}
 	if o.conf.TagKey != "" {
-		ev.Record[o.conf.TagKey] = ev.Tag
+		record[o.conf.TagKey] = ev.Tag
 	}
 
 	action := map[string]string{
@@ -77,12 +86,12 @@ func (o *ElasticsearchOutput) Encode(ev *message.Event) (buffer.Sizer, error) {
 		"_type":  o.conf.TypeName,
 	}
 	if o.conf.IDKey != "" {
-		if v, ok := ev.Record[o.conf.IDKey].(string); ok {
+		if v, ok := record[o.conf.IDKey].(string); ok {
 			action["_id"] = v
 		}
 	}
 	if o.conf.ParentKey != "" {
-		if v, ok := ev.Record[o.conf.ParentKey].(string); ok {
+		if v, ok := record[o.conf.ParentKey].(string); ok {
 			action["_parent"] = v
 		}
 	}
@@ -91,7 +100,7 @@ func (o *ElasticsearchOutput) Encode(ev *message.Event) (buffer.Sizer, error) {
 	if err != nil {
 		return nil, err
 	}
-	b2, err := json.Marshal(ev.Record)
+	b2, err := json.Marshal(record)
 	if err != nil {
 		return nil, err
 	}
@@ -106,19 +115,42 @@ func (o *ElasticsearchOutput) Write(l []buffer.Sizer) (int, error) {
 	for _, b := range l {
 		rs = append(rs, bytes.NewReader(b.(buffer.BytesItem)))
 	}
+	if err := o.post(io.MultiReader(rs...), ""); err != nil {
+		return 0, err
+	}
+	return len(l), nil
+}
+
+// AcceptCompressed reports that gzip chunks can be sent as gzip bodies.
+func (o *ElasticsearchOutput) AcceptCompressed(format buffer.Compression) bool {
+	return format == buffer.CompressGzip
+}
+
+func (o *ElasticsearchOutput) WriteCompressed(meta *buffer.Metadata, c *buffer.CompressedItem) error {
+	return o.post(bytes.NewReader(c.Data), "gzip")
+}
 
-	resp, err := o.client.Post(o.conf.URI, "application/json", io.MultiReader(rs...))
+func (o *ElasticsearchOutput) post(body io.Reader, encoding string) error {
+	req, err := http.NewRequest("POST", o.conf.URI, body)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
 	b, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("Error %s, body: %s", resp.Status, b)
+		return fmt.Errorf("Error %s, body: %s", resp.Status, b)
 	}
-
-	return len(l), nil
+	return nil
 }
 
 func (o *ElasticsearchOutput) Close() error {
@@ -0,0 +1,64 @@
+package out_elasticsearch
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin/plugintest"
+)
+
+func TestCompressedBulk(t *testing.T) {
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "not gzip", http.StatusBadRequest)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bodies <- string(b)
+	}))
+	defer ts.Close()
+
+	h := plugintest.New(Factory, fmt.Sprintf(`
+uri = "%s/_bulk"
+index_name = "test"
+`, ts.URL))
+	h.Buffer = &buffer.Options{
+		Compress:      buffer.CompressGzip,
+		FlushInterval: buffer.Duration(time.Hour),
+	}
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var expected string
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, h.Push(message.NewEvent("foo", map[string]interface{}{"seq": i})))
+		expected += `{"index":{"_index":"test","_type":"fluxion"}}` + "\n" + fmt.Sprintf(`{"seq":%d}`, i) + "\n"
+	}
+	assert.NoError(t, h.Close())
+	assert.Len(t, h.Written(), 3)
+
+	select {
+	case body := <-bodies:
+		assert.Equal(t, expected, body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing is posted")
+	}
+}
@@ -2,9 +2,12 @@ package out_file
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"text/template"
 
@@ -19,11 +22,17 @@ type Config struct {
 }
 
 type OutFile struct {
-	env  *plugin.Env
-	conf Config
-	tmpl *template.Template
-	ino  uint64
-	w    *os.File
+	env   *plugin.Env
+	conf  Config
+	tmpl  *template.Template
+	ptmpl *template.Template
+	path  string
+	ino   uint64
+	w     *os.File
+}
+
+func (p *OutFile) ConfigSchema() interface{} {
+	return &Config{}
 }
 
 func (p *OutFile) Init(env *plugin.Env) (err error) {
@@ -32,7 +41,12 @@ func (p *OutFile) Init(env *plugin.Env) (err error) {
 		return
 	}
 	if p.conf.Format != "" {
-		p.tmpl, err = template.New("").Parse(p.conf.Format)
+		if p.tmpl, err = template.New("").Parse(p.conf.Format); err != nil {
+			return
+		}
+	}
+	if strings.Contains(p.conf.Path, "{{") {
+		p.ptmpl, err = template.New("path").Parse(p.conf.Path)
 	}
 	return
 }
@@ -58,9 +72,33 @@ func (p *OutFile) Encode(ev *message.Event) (buffer.Sizer, error) {
 }
 
 func (p *OutFile) Write(l []buffer.Sizer) (int, error) {
-	if err := p.reopen(); err != nil {
+	return p.WriteChunk(nil, l)
+}
+
+// WriteChunk writes items into the file for the chunk. The path can be a
+// template rendered with the chunk metadata, e.g. {{.Tag}} and
+// {{.Timekey.Format "2006010215"}}, to make a file per chunk key. If the path
+// ends with .gz, items are appended as a gzip member.
+func (p *OutFile) WriteChunk(meta *buffer.Metadata, l []buffer.Sizer) (int, error) {
+	path, err := p.realPath(meta)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.reopen(path); err != nil {
 		return 0, err
 	}
+	if p.gzipped() {
+		w := gzip.NewWriter(p.w)
+		for _, b := range l {
+			if _, err := w.Write(b.(buffer.BytesItem)); err != nil {
+				return 0, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return 0, err
+		}
+		return len(l), nil
+	}
 	for i, b := range l {
 		if _, err := p.w.Write(b.(buffer.BytesItem)); err != nil {
 			return i, err
@@ -69,24 +107,68 @@ func (p *OutFile) Write(l []buffer.Sizer) (int, error) {
 	return len(l), nil
 }
 
-func (p *OutFile) reopen() error {
-	ino, err := inode(p.conf.Path)
+// AcceptCompressed reports that gzip chunks can be appended to .gz files as
+// they are, since concatenated gzip members form a valid gzip file.
+func (p *OutFile) AcceptCompressed(format buffer.Compression) bool {
+	return format == buffer.CompressGzip && p.gzipped()
+}
+
+func (p *OutFile) WriteCompressed(meta *buffer.Metadata, c *buffer.CompressedItem) error {
+	path, err := p.realPath(meta)
+	if err != nil {
+		return err
+	}
+	if err := p.reopen(path); err != nil {
+		return err
+	}
+	_, err = p.w.Write(c.Data)
+	return err
+}
+
+func (p *OutFile) gzipped() bool {
+	return strings.HasSuffix(p.conf.Path, ".gz")
+}
+
+func (p *OutFile) realPath(meta *buffer.Metadata) (string, error) {
+	if p.ptmpl == nil {
+		return p.conf.Path, nil
+	}
+	if meta == nil {
+		meta = &buffer.Metadata{}
+	}
+	b := new(bytes.Buffer)
+	if err := p.ptmpl.Execute(b, meta); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (p *OutFile) reopen(path string) error {
+	ino, err := inode(path)
 	if err != nil {
 		return err
 	}
-	if p.ino != ino && p.w != nil {
-		p.env.Log.Infof("Rotation detected: %s", p.conf.Path)
+	if p.w != nil && (p.path != path || p.ino != ino) {
+		if p.path == path {
+			p.env.Log.Infof("Rotation detected: %s", path)
+		}
 		p.w.Close()
 		p.w = nil
 	}
 	if p.w == nil {
-		w, err := os.OpenFile(p.conf.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+		if p.ptmpl != nil {
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+		}
+		w, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
 		if err != nil {
 			return err
 		}
 		p.w = w
+		p.path = path
 		if ino == 0 {
-			if ino, err = inode(p.conf.Path); err != nil {
+			if ino, err = inode(path); err != nil {
 				return err
 			}
 		}
@@ -96,6 +178,9 @@ func (p *OutFile) reopen() error {
 }
 
 func (p *OutFile) Close() error {
+	if p.w == nil {
+		return nil
+	}
 	return p.w.Close()
 }
 
@@ -0,0 +1,76 @@
+package out_file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin/plugintest"
+)
+
+func tempdir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "fluxion-out-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWrite(t *testing.T) {
+	dir := tempdir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+	h := plugintest.New(Factory, `
+path = "`+path+`"
+format = "{{.Tag}} {{.Record.key}}"
+`)
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, h.Push(message.NewEvent("foo", map[string]interface{}{"key": 1})))
+	assert.NoError(t, h.Push(message.NewEvent("bar", map[string]interface{}{"key": 2})))
+
+	// Items of the failed write are written by the next flush
+	h.FailWrites(1, nil)
+	assert.Error(t, h.Flush())
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, h.Flush())
+	assert.Equal(t, "foo 1\nbar 2\n", readFile(t, path))
+
+	assert.NoError(t, h.Push(message.NewEvent("baz", map[string]interface{}{"key": 3})))
+	assert.NoError(t, h.Close())
+	assert.Equal(t, "foo 1\nbar 2\nbaz 3\n", readFile(t, path))
+}
+
+func TestWriteChunkPath(t *testing.T) {
+	dir := tempdir(t)
+	defer os.RemoveAll(dir)
+	h := plugintest.New(Factory, `
+path = "`+dir+`/{{.Tag}}/out.log"
+format = "{{.Record.key}}"
+`)
+	h.Buffer = &buffer.Options{ChunkKeys: []string{"tag"}}
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, h.Push(message.NewEvent("foo", map[string]interface{}{"key": 1})))
+	assert.NoError(t, h.Push(message.NewEvent("bar", map[string]interface{}{"key": 2})))
+	assert.True(t, h.WaitWritten(2, 5*time.Second))
+	assert.NoError(t, h.Close())
+	assert.Equal(t, "1\n", readFile(t, filepath.Join(dir, "foo", "out.log")))
+	assert.Equal(t, "2\n", readFile(t, filepath.Join(dir, "bar", "out.log")))
+}
@@ -58,6 +58,11 @@ type ForwardOutput struct {
 	conf       *Config
 	w          io.Writer
 	ackEnabled bool
+	packed     bool
+}
+
+func (o *ForwardOutput) ConfigSchema() interface{} {
+	return &Config{}
 }
 
 func (o *ForwardOutput) Init(env *plugin.Env) (err error) {
@@ -77,6 +82,15 @@ func (o *ForwardOutput) Init(env *plugin.Env) (err error) {
 	o.ackEnabled = (o.conf.Compatible == CompatibleDisable && o.conf.AckTimeout > 0) ||
 		o.conf.Compatible == CompatibleExtend
 
+	// Chunks split by tag are sent in CompressedPackedForward mode. It's not
+	// available with ack since the writer appends another option for it.
+	o.packed = env.Buffer != nil && env.Buffer.Compress == buffer.CompressGzip &&
+		o.conf.Compatible == CompatibleDisable && !o.ackEnabled && hasTagKey(env.Buffer.ChunkKeys)
+	if env.Buffer != nil && env.Buffer.Compress != buffer.CompressNone && !o.packed {
+		env.Log.Warning("Chunks are sent uncompressed, compressed forwarding requires gzip, " +
+			`compatible = "disable", no ack_timeout and "tag" in chunk_keys`)
+	}
+
 	var seq sequencer
 	if o.ackEnabled {
 		var s sequence
@@ -122,7 +136,10 @@ func decode(b []byte, v interface{}) error {
 
 func (o *ForwardOutput) Encode(ev *message.Event) (buffer.Sizer, error) {
 	var v []interface{}
-	if o.conf.Compatible == CompatibleDisable {
+	if o.packed {
+		// Entries of the tag are packed on write
+		v = []interface{}{ev.Time, ev.Record}
+	} else if o.conf.Compatible == CompatibleDisable {
 		v = []interface{}{ev.Tag, ev.Time, ev.Record}
 	} else {
 		v = []interface{}{ev.Tag, ev.Time.Unix(), ev.Record}
@@ -148,6 +165,58 @@ func (o *ForwardOutput) Write(l []buffer.Sizer) (int, error) {
 	return len(l), nil
 }
 
+// WriteChunk sends all entries of the chunk at once in packed mode.
+// Otherwise, events are sent one by one.
+func (o *ForwardOutput) WriteChunk(meta *buffer.Metadata, l []buffer.Sizer) (int, error) {
+	if !o.packed {
+		return o.Write(l)
+	}
+	var entries []byte
+	for _, b := range l {
+		entries = append(entries, b.(buffer.BytesItem)...)
+	}
+	if err := o.send(meta.Tag, entries, nil); err != nil {
+		return 0, err
+	}
+	return len(l), nil
+}
+
+func (o *ForwardOutput) AcceptCompressed(format buffer.Compression) bool {
+	return o.packed && format == buffer.CompressGzip
+}
+
+func (o *ForwardOutput) WriteCompressed(meta *buffer.Metadata, c *buffer.CompressedItem) error {
+	return o.send(meta.Tag, c.Data, map[string]interface{}{
+		"compressed": "gzip",
+		"size":       c.Len(),
+	})
+}
+
+func (o *ForwardOutput) send(tag string, entries []byte, option map[string]interface{}) error {
+	v := []interface{}{tag, entries}
+	if option != nil {
+		v = append(v, option)
+	}
+	b, err := encode(v)
+	if err != nil {
+		return err
+	}
+	if _, err = o.w.Write(b); err != nil {
+		o.env.Log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func hasTagKey(keys []string) bool {
+	for _, k := range keys {
+		if k == "tag" {
+			return true
+		}
+	}
+	return false
+}
+
 func (o *ForwardOutput) Close() error {
 	return nil
 }
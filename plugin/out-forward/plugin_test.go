@@ -0,0 +1,158 @@
+package out_forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin/in-forward"
+	"github.com/yosisa/fluxion/plugin/plugintest"
+)
+
+// packedForward creates the harness sending chunks split by tag compressed.
+func packedForward(t *testing.T, server string) *plugintest.Harness {
+	h := plugintest.New(Factory, fmt.Sprintf(`
+[[servers]]
+server = "%s"
+`, server))
+	h.Buffer = &buffer.Options{
+		Compress:      buffer.CompressGzip,
+		ChunkKeys:     []string{"tag"},
+		FlushInterval: buffer.Duration(time.Hour),
+	}
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func pushEvents(t *testing.T, h *plugintest.Harness, n int) {
+	for i := 0; i < n; i++ {
+		assert.NoError(t, h.Push(message.NewEvent("foo", map[string]interface{}{
+			"message": strings.Repeat("hello ", 10),
+			"seq":     i,
+		})))
+	}
+}
+
+func TestCompressedPackedForward(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []interface{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var v []interface{}
+		if err := codec.NewDecoder(conn, &codec.MsgpackHandle{RawToString: true}).Decode(&v); err == nil {
+			received <- v
+		}
+	}()
+
+	h := packedForward(t, ln.Addr().String())
+	pushEvents(t, h, 10)
+	assert.NoError(t, h.Close())
+	assert.Len(t, h.Written(), 10)
+	assert.Empty(t, h.Logs("warning"))
+
+	var v []interface{}
+	select {
+	case v = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing is forwarded")
+	}
+	if !assert.Len(t, v, 3) {
+		return
+	}
+	assert.Equal(t, "foo", v[0])
+	opts := v[2].(map[interface{}]interface{})
+	assert.Equal(t, "gzip", opts["compressed"])
+	assert.EqualValues(t, 10, opts["size"])
+
+	// Entries are the concatenated [time, record] in gzip
+	var entries []byte
+	switch typed := v[1].(type) {
+	case []byte:
+		entries = typed
+	case string:
+		entries = []byte(typed)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(entries))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	br := bytes.NewReader(b)
+	dec := codec.NewDecoder(br, mh)
+	var n int
+	for ; br.Len() > 0; n++ {
+		var entry []interface{}
+		if !assert.NoError(t, dec.Decode(&entry)) {
+			return
+		}
+		assert.Len(t, entry, 2)
+	}
+	assert.Equal(t, 10, n)
+}
+
+func TestForwardToInForward(t *testing.T) {
+	// in-forward binds the port for both TCP and UDP
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	in := plugintest.New(in_forward.Factory, fmt.Sprintf(`bind = "%s"`, addr))
+	if err := in.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	h := packedForward(t, addr)
+	pushEvents(t, h, 10)
+	assert.NoError(t, h.Close())
+	if !in.WaitEvents(10, 5*time.Second) {
+		t.Fatalf("Expected 10 events, but %d", len(in.Events()))
+	}
+	for i, ev := range in.Events() {
+		assert.Equal(t, "foo", ev.Tag)
+		assert.EqualValues(t, i, ev.Record["seq"])
+		assert.Equal(t, strings.Repeat("hello ", 10), ev.Record["message"])
+	}
+}
+
+func TestUncompressedWarning(t *testing.T) {
+	h := plugintest.New(Factory, `
+ack_timeout = "1s"
+
+[[servers]]
+server = "127.0.0.1:24224"
+`)
+	h.Buffer = &buffer.Options{Compress: buffer.CompressGzip, ChunkKeys: []string{"tag"}}
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if assert.Len(t, h.Logs("warning"), 1) {
+		assert.Contains(t, h.Logs("warning")[0], "Chunks are sent uncompressed")
+	}
+}
@@ -21,6 +21,10 @@ type StdoutOutput struct {
 	tmpl *template.Template
 }
 
+func (o *StdoutOutput) ConfigSchema() interface{} {
+	return &Config{}
+}
+
 func (o *StdoutOutput) Init(env *plugin.Env) (err error) {
 	o.env = env
 	o.conf = &Config{}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/BurntSushi/toml"
@@ -26,7 +27,12 @@ type PluginFactory func() Plugin
 type Env struct {
 	ReadConfig func(interface{}) error
 	Emit       func(*message.Event)
-	Log        *log.Logger
+	// EmitWithAck emits the event, then calls the function after outputs
+	// have written the event
+	EmitWithAck func(*message.Event, func())
+	Log         *log.Logger
+	// Buffer options of the output plugin, nil for other plugins
+	Buffer *buffer.Options
 }
 
 type Plugin interface {
@@ -41,16 +47,54 @@ type OutputPlugin interface {
 	Write([]buffer.Sizer) (int, error)
 }
 
+// ChunkWriter is optionally implemented by output plugins to receive the
+// metadata of the chunk along with its items.
+type ChunkWriter interface {
+	WriteChunk(*buffer.Metadata, []buffer.Sizer) (int, error)
+}
+
+// CompressedWriter is optionally implemented by output plugins which can send
+// chunks compressed by the buffer without decompression.
+type CompressedWriter interface {
+	AcceptCompressed(buffer.Compression) bool
+	WriteCompressed(*buffer.Metadata, *buffer.CompressedItem) error
+}
+
+// Checker is optionally implemented by plugins whose Init has side effects,
+// such as creating files. Check validates the config instead of Init, and
+// is called by "fluxion -check".
+type Checker interface {
+	Check(*Env) error
+}
+
+// MetricsReporter is optionally implemented by plugins to report their own
+// metrics along with the stats collected by the framework.
+type MetricsReporter interface {
+	Metrics() []*message.Metric
+}
+
 type FilterPlugin interface {
 	Plugin
 	Filter(*message.Event) (*message.Event, error)
 }
 
 type plugin struct {
-	name  string
-	f     PluginFactory
-	units map[int32]*execUnit
-	pipe  pipe.Pipe
+	// Reported to the engine, optional
+	Version string
+	name    string
+	f       PluginFactory
+	units   map[int32]*execUnit
+	// Guards units written by eventLoop and read by others
+	um       sync.Mutex
+	pipe     pipe.Pipe
+	stopping sync.WaitGroup
+	gate     gate
+	// Negotiated with the engine, given to units
+	peer *message.PluginInfo
+	// Switches the pipes to the negotiated version, nil if in process
+	setVersion func(uint8)
+	// Called once after negotiated
+	negotiated func()
 }
 
 func New(name string, f PluginFactory) *plugin {
@@ -62,7 +106,17 @@ func New(name string, f PluginFactory) *plugin {
 }
 
 func (p *plugin) Run() {
-	p.pipe = pipe.NewInterProcess(nil, os.Stdout)
+	// Messages are read and written in the oldest version until negotiated
+	rp := pipe.NewInterProcess(os.Stdin, nil)
+	wp := pipe.NewInterProcess(nil, os.Stdout)
+	wp.Checksum = os.Getenv(pipe.ChecksumEnv) != ""
+	rp.SetVersion(message.MinProtoVer)
+	wp.SetVersion(message.MinProtoVer)
+	p.pipe = wp
+	p.setVersion = func(ver uint8) {
+		rp.SetVersion(ver)
+		wp.SetVersion(ver)
+	}
 	// Redirect os.Stdout, because plugins maybe write to stdout
 	r, w, err := os.Pipe()
 	if err != nil {
@@ -70,10 +124,15 @@ func (p *plugin) Run() {
 		os.Exit(1)
 	}
 	os.Stdout = w
-	go p.stdoutTransfer(r)
+	// Transferred after negotiated, not to be mixed with the response
+	p.negotiated = func() { go p.stdoutTransfer(r) }
 
 	go p.signalHandler()
-	p.eventLoop(pipe.NewInterProcess(os.Stdin, nil))
+	if err := p.eventLoop(rp); err != nil {
+		// Exits with an error, so that the engine restarts the process
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func (p *plugin) RunWithPipe(rp pipe.Pipe, wp pipe.Pipe) {
@@ -81,28 +140,76 @@ func (p *plugin) RunWithPipe(rp pipe.Pipe, wp pipe.Pipe) {
 	p.eventLoop(rp)
 }
 
-func (p *plugin) eventLoop(pipe pipe.Pipe) {
+// eventLoop handles messages from the engine. It returns an error if the
+// stream is broken, or nil when stopped.
+func (p *plugin) eventLoop(rp pipe.Pipe) error {
 	for {
-		m, err := pipe.Read()
-		if err != nil {
-			return
+		m, err := rp.Read()
+		if ferr, ok := err.(*pipe.FrameError); ok {
+			// The message is skipped, the engine decides what to do
+			p.pipe.Write(&message.Message{
+				Type:    message.TypProtocolError,
+				Payload: &message.ProtocolError{Type: ferr.Type, Error: ferr.Err.Error()},
+			})
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
 
 		switch m.Type {
 		case message.TypInfoRequest:
-			p.pipe.Write(&message.Message{
-				Type:    message.TypInfoResponse,
-				Payload: &message.PluginInfo{ProtoVer: 1},
-			})
+			info := Info(p.f)
+			info.Version = p.Version
+			p.peer = info.Negotiate(m.Payload.(*message.PluginInfo))
+			p.pipe.Write(&message.Message{Type: message.TypInfoResponse, Payload: info})
+			if p.setVersion != nil {
+				p.setVersion(p.peer.ProtoVer)
+			}
+			if p.negotiated != nil {
+				p.negotiated()
+				p.negotiated = nil
+			}
 		case message.TypStop:
+			// Blocked inputs must return to be closed
+			p.gate.resume()
 			p.stop()
 			p.pipe.Write(&message.Message{Type: message.TypTerminated})
-			return
+			return nil
+		case message.TypCheck:
+			p.check(m)
+		case message.TypStatsRequest:
+			p.stats()
+		case message.TypAck:
+			if unit, ok := p.units[m.UnitID]; ok {
+				for _, o := range m.Payload.([]message.Origin) {
+					unit.acks.done(o.Seq)
+				}
+			}
+		case message.TypPause:
+			p.gate.pause()
+		case message.TypResume:
+			p.gate.resume()
+		case message.TypStopUnit:
+			if unit, ok := p.units[m.UnitID]; ok {
+				p.um.Lock()
+				delete(p.units, m.UnitID)
+				p.um.Unlock()
+				p.stopping.Add(1)
+				go func() {
+					unit.stop()
+					p.stopping.Done()
+				}()
+			}
 		default:
 			unit, ok := p.units[m.UnitID]
 			if !ok {
-				unit = newExecUnit(m.UnitID, p.name, p.f(), p.pipe)
+				unit = newExecUnit(m.UnitID, p.name, p.f(), p.pipe, &p.gate, p.peer)
+				p.um.Lock()
 				p.units[m.UnitID] = unit
+				p.um.Unlock()
 			}
 			unit.msgC <- m
 		}
@@ -119,6 +226,8 @@ func (p *plugin) stop() {
 		}(unit)
 	}
 	wg.Wait()
+	// Wait for units removed on reload
+	p.stopping.Wait()
 }
 
 func (p *plugin) stdoutTransfer(f *os.File) {
@@ -141,24 +250,69 @@ func (p *plugin) stdoutTransfer(f *os.File) {
 	}
 }
 
+// signalHandler ignores SIGINT sent to the process group, and interrupts the
+// buffers instead, since the engine is going to stop the plugin.
 func (p *plugin) signalHandler() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT)
 	for _ = range c {
+		p.Interrupt()
+	}
+}
+
+// Interrupt makes the buffers of the units stop blocking when full, so that
+// the stop message from the engine is read. The engine sends SIGINT to plugin
+// processes before stopping them.
+func (p *plugin) Interrupt() {
+	p.um.Lock()
+	defer p.um.Unlock()
+	for _, unit := range p.units {
+		unit.m.Lock()
+		if unit.buf != nil {
+			unit.buf.Interrupt()
+		}
+		unit.m.Unlock()
 	}
 }
 
 type execUnit struct {
-	ID    int32
-	name  string
-	p     Plugin
-	msgC  chan *message.Message
-	doneC chan bool
-	pipe  pipe.Pipe
-	log   *log.Logger
+	ID        int32
+	name      string
+	p         Plugin
+	msgC      chan *message.Message
+	doneC     chan bool
+	pipe      pipe.Pipe
+	log       *log.Logger
+	secondary bool
+	gate      *gate
+	pressured int32
+	acks      *acks
+	handoff   handoff
+	batch     *batcher
+	// Capabilities of the engine
+	peer *message.PluginInfo
+	// Counters reported as stats, accessed atomically
+	emitted      int64
+	filtered     int64
+	written      int64
+	filterErrors int64
+	encodeErrors int64
+	eventsIn     tagCounter
+	eventsOut    tagCounter
+	buf          buffer.Buffer
+	m            sync.Mutex
+}
+
+// outputConfig holds output settings handled by the framework.
+type outputConfig struct {
+	Secondary map[string]interface{} `toml:"secondary"`
 }
 
-func newExecUnit(id int32, name string, p Plugin, pipe pipe.Pipe) *execUnit {
+func newExecUnit(id int32, name string, p Plugin, pipe pipe.Pipe, g *gate, peer *message.PluginInfo) *execUnit {
+	if peer == nil {
+		// Units may be created by the engine not asking the info
+		peer = &message.PluginInfo{ProtoVer: message.MinProtoVer}
+	}
 	u := &execUnit{
 		ID:    id,
 		name:  name,
@@ -166,27 +320,105 @@ func newExecUnit(id int32, name string, p Plugin, pipe pipe.Pipe) *execUnit {
 		msgC:  make(chan *message.Message, 100),
 		doneC: make(chan bool),
 		pipe:  pipe,
+		gate:  g,
+		acks:  newAcks(),
+		peer:  peer,
 	}
+	u.batch = newBatcher(u.send)
 	u.log = &log.Logger{
 		Name:     name,
 		Prefix:   fmt.Sprintf("[%02d:%s] ", id, name),
 		EmitFunc: u.emit,
 	}
 	go u.eventLoop()
+	go u.handoffLoop()
 	return u
 }
 
 func (u *execUnit) eventLoop() {
+	defer close(u.doneC)
 	op, isOutputPlugin := u.p.(OutputPlugin)
 	fp, isFilterPlugin := u.p.(FilterPlugin)
-	var buf *buffer.Memory
+	var buf buffer.Buffer
+	var bopts *buffer.Options
+	var failure error
+	defer func() {
+		if failure != nil {
+			u.fail(failure)
+		}
+	}()
 	u.log.Info("plugin started")
 
+	// filter returns the event to be passed to the next, or nil if dropped
+	filter := func(ev *message.Event) *message.Event {
+		atomic.AddInt64(&u.filtered, 1)
+		u.eventsIn.add(ev.Tag)
+		r, err := fp.Filter(ev)
+		if err != nil {
+			atomic.AddInt64(&u.filterErrors, 1)
+			u.log.Warning("Filter error: ", err)
+			r = ev
+		}
+		if r == nil {
+			// Dropped events are delivered as far as the input concerns
+			u.ack(ev.Origin)
+			return nil
+		}
+		atomic.AddInt64(&u.emitted, 1)
+		u.eventsOut.add(r.Tag)
+		r.Origin = ev.Origin
+		return r
+	}
+	push := func(ev *message.Event, seq uint64) {
+		u.eventsIn.add(ev.Tag)
+		meta := bopts.Metadata(ev.Tag, ev.Time, ev.Record)
+		s, err := op.Encode(ev)
+		if err != nil {
+			atomic.AddInt64(&u.encodeErrors, 1)
+			u.log.Warning("Encode error: ", err)
+			u.delivered(ev.Origin, seq)
+			return
+		}
+		if s == nil {
+			u.delivered(ev.Origin, seq)
+			return
+		}
+		// Events in file buffers survive the crash of the process, so they
+		// are confirmed after pushed.
+		itemSeq := seq
+		if bopts.Type == "file" {
+			itemSeq = 0
+		}
+		if u.secondary {
+			s = &eventItem{s, ev, itemSeq}
+		} else if ev.Origin != nil || itemSeq != 0 {
+			s = &ackItem{s, ev.Origin, itemSeq}
+		}
+		// With the block overflow action, Push waits for a room in the
+		// queue. Meanwhile msgC is not consumed, so writes from the engine
+		// stall and the inputs are blocked in turn.
+		if err = buf.PushWithMetadata(meta, s); err != nil {
+			u.log.Warning("Buffering error: ", err)
+			u.delivered(ev.Origin, seq)
+		} else if itemSeq == 0 {
+			u.handoff.confirm(seq)
+		}
+		u.checkPressure(buf, bopts)
+	}
+
 	for m := range u.msgC {
 		switch m.Type {
 		case message.TypBufferOption:
 			if isOutputPlugin {
-				buf = buffer.NewMemory(m.Payload.(*buffer.Options), op)
+				var err error
+				bopts = m.Payload.(*buffer.Options)
+				if buf, err = buffer.New(bopts, &outputHandler{u, op}, u.log); err != nil {
+					failure = fmt.Errorf("Failed to create buffer: %v", err)
+					return
+				}
+				u.m.Lock()
+				u.buf = buf
+				u.m.Unlock()
 			}
 		case message.TypConfigure:
 			s := m.Payload.(string)
@@ -195,40 +427,63 @@ func (u *execUnit) eventLoop() {
 					_, err := toml.Decode(s, v)
 					return err
 				},
-				Emit: u.emit,
-				Log:  u.log,
+				Emit:        u.emitEvent,
+				EmitWithAck: u.emitWithAck,
+				Log:         u.log,
+				Buffer:      bopts,
 			}
 			if err := u.p.Init(env); err != nil {
-				u.log.Critical("Failed to configure: ", err)
+				failure = fmt.Errorf("Failed to configure: %v", err)
 				return
 			}
+			if isOutputPlugin {
+				var oc outputConfig
+				if err := env.ReadConfig(&oc); err != nil {
+					failure = fmt.Errorf("Failed to configure: %v", err)
+					return
+				}
+				u.secondary = oc.Secondary != nil
+			}
 		case message.TypStart:
 			if err := u.p.Start(); err != nil {
-				u.log.Critical("Failed to start: ", err)
+				failure = fmt.Errorf("Failed to start: %v", err)
 				return
 			}
 		case message.TypEvent:
+			ev := m.Payload.(*message.Event)
 			switch {
 			case isFilterPlugin:
-				ev := m.Payload.(*message.Event)
-				r, err := fp.Filter(ev)
-				if err != nil {
-					u.log.Warning("Filter error: ", err)
-					r = ev
-				}
-				if r != nil {
+				if r := filter(ev); r != nil {
 					u.send(&message.Message{Type: message.TypEventChain, Payload: r})
 				}
+				u.handoff.confirm(m.Seq)
 			case isOutputPlugin:
-				s, err := op.Encode(m.Payload.(*message.Event))
-				if err != nil {
-					u.log.Warning("Encode error: ", err)
-					continue
+				push(ev, m.Seq)
+			}
+		case message.TypEventBatch:
+			batch := m.Payload.(*message.EventBatch)
+			switch {
+			case isFilterPlugin:
+				var l []*message.Event
+				for _, ev := range batch.Events {
+					if r := filter(ev); r != nil {
+						l = append(l, r)
+					}
 				}
-				if s != nil {
-					if err = buf.Push(s); err != nil {
-						u.log.Warning("Buffering error: ", err)
+				if len(l) > 0 {
+					u.send(&message.Message{
+						Type:    message.TypEventBatch,
+						Payload: &message.EventBatch{Chain: true, Events: l},
+					})
+				}
+				u.handoff.confirm(batch.Seqs...)
+			case isOutputPlugin:
+				for i, ev := range batch.Events {
+					var seq uint64
+					if i < len(batch.Seqs) {
+						seq = batch.Seqs[i]
 					}
+					push(ev, seq)
 				}
 			}
 		case message.TypStop:
@@ -236,15 +491,54 @@ func (u *execUnit) eventLoop() {
 				buf.Close()
 			}
 			u.p.Close()
+			// Events emitted until closed are not left behind
+			u.batch.flush()
+		}
+	}
+}
+
+// fail reports the unit unusable to the engine. Messages are discarded until
+// stopped, so that neither the plugin nor the engine is blocked by the unit.
+// Events are delivered as far as the inputs concern.
+func (u *execUnit) fail(err error) {
+	u.log.Critical(err)
+	if u.peer.Has(message.CapFail) {
+		u.send(&message.Message{Type: message.TypUnitFailed, Payload: err.Error()})
+	}
+	for m := range u.msgC {
+		switch m.Type {
+		case message.TypEvent:
+			u.delivered(m.Payload.(*message.Event).Origin, m.Seq)
+		case message.TypEventBatch:
+			batch := m.Payload.(*message.EventBatch)
+			for i, ev := range batch.Events {
+				var seq uint64
+				if i < len(batch.Seqs) {
+					seq = batch.Seqs[i]
+				}
+				u.delivered(ev.Origin, seq)
+			}
 		}
 	}
-	close(u.doneC)
 }
 
 func (u *execUnit) emit(ev *message.Event) {
 	u.send(&message.Message{Type: message.TypEvent, Payload: ev})
 }
 
+// emitEvent emits the event given by the plugin. Unlike logs, it's counted,
+// sent in batches, and blocks while inputs are paused.
+func (u *execUnit) emitEvent(ev *message.Event) {
+	u.gate.wait()
+	atomic.AddInt64(&u.emitted, 1)
+	u.eventsOut.add(ev.Tag)
+	if u.peer.Has(message.CapBatch) {
+		u.batch.add(ev)
+	} else {
+		u.emit(ev)
+	}
+}
+
 func (u *execUnit) send(m *message.Message) {
 	m.UnitID = u.ID
 	u.pipe.Write(m)
@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/pipe"
+)
+
+func TestUnitFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluxion-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The buffer directory can't be created in the read-only directory. Root
+	// writes to any directory, but not under a file.
+	parent := filepath.Join(dir, "readonly")
+	if os.Geteuid() == 0 {
+		err = ioutil.WriteFile(parent, nil, 0400)
+	} else {
+		err = os.Mkdir(parent, 0500)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &compressedOutput{chunks: make(chan *buffer.CompressedItem, 10)}
+	p := pipe.NewInProcess()
+	peer := &message.PluginInfo{ProtoVer: message.ProtoVer, Capabilities: []string{message.CapFail}}
+	u := newExecUnit(1, "out-test", out, p, &gate{}, peer)
+
+	bopts := &buffer.Options{Type: "file", Path: filepath.Join(parent, "buffer")}
+	bopts.SetDefault()
+	u.msgC <- &message.Message{Type: message.TypBufferOption, Payload: bopts}
+	u.msgC <- &message.Message{Type: message.TypConfigure, Payload: ""}
+	u.msgC <- &message.Message{Type: message.TypStart}
+	ev := message.NewEvent("foo", nil)
+	ev.Origin = &message.Origin{Unit: 5, Seq: 10}
+	u.msgC <- &message.Message{Type: message.TypEvent, Payload: ev}
+
+	// Logs are sent as events in between
+	read := func(typ message.MessageType) *message.Message {
+		for {
+			if m, _ := p.Read(); m.Type == typ {
+				return m
+			}
+		}
+	}
+	// The failure is reported, and events are discarded
+	m := read(message.TypUnitFailed)
+	assert.Contains(t, m.Payload, "Failed to create buffer")
+	m = read(message.TypAck)
+	assert.Equal(t, []message.Origin{*ev.Origin}, m.Payload)
+
+	stopped := make(chan struct{})
+	go func() {
+		u.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failed unit is not stopped")
+	}
+}
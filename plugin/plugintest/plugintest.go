@@ -0,0 +1,377 @@
+// Package plugintest drives plugins through Init, Start, Filter or
+// Encode/Write, and Close without the engine, to unit test them.
+//
+//	h := plugintest.New(out_file.Factory, `path = "/tmp/out.log"`)
+//	if err := h.Init(); err != nil {
+//		t.Fatal(err)
+//	}
+//	h.Push(message.NewEvent("foo", map[string]interface{}{"key": "value"}))
+//	h.Flush()
+//	h.Close()
+//
+// Events emitted by the plugin and its logs are captured by the harness.
+package plugintest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/log"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+// ErrWrite is returned by writes failed by FailWrites without an error.
+var ErrWrite = errors.New("plugintest: write failed")
+
+// Harness runs a plugin with a config in TOML. Output plugins push encoded
+// events into a buffer, and items written by the plugin are recorded.
+type Harness struct {
+	Plugin plugin.Plugin
+	// Given to Plugin.Init, available after New
+	Env *plugin.Env
+	// Buffer options of output plugins, set before Init. If nil, items are
+	// held until Flush, and written synchronously.
+	Buffer *buffer.Options
+
+	opts     *buffer.Options
+	buf      buffer.Buffer
+	events   []*message.Event
+	acks     []func()
+	logs     []*message.Event
+	written  []buffer.Sizer
+	writes   int
+	failures []error
+	m        sync.Mutex
+}
+
+// New creates the plugin by the factory. The config is decoded by
+// Env.ReadConfig.
+func New(f plugin.PluginFactory, conf string) *Harness {
+	h := &Harness{Plugin: f()}
+	h.Env = &plugin.Env{
+		ReadConfig: func(v interface{}) error {
+			_, err := toml.Decode(conf, v)
+			return err
+		},
+		Emit: func(ev *message.Event) {
+			h.m.Lock()
+			h.events = append(h.events, ev)
+			h.m.Unlock()
+		},
+		EmitWithAck: func(ev *message.Event, f func()) {
+			h.m.Lock()
+			h.events = append(h.events, ev)
+			h.acks = append(h.acks, f)
+			h.m.Unlock()
+		},
+		Log: &log.Logger{
+			Name: "plugintest",
+			EmitFunc: func(ev *message.Event) {
+				h.m.Lock()
+				h.logs = append(h.logs, ev)
+				h.m.Unlock()
+			},
+		},
+	}
+	return h
+}
+
+// Init initializes the plugin. The buffer is created for output plugins.
+func (h *Harness) Init() (err error) {
+	op, isOutputPlugin := h.Plugin.(plugin.OutputPlugin)
+	if isOutputPlugin {
+		h.opts = &buffer.Options{}
+		if h.Buffer != nil {
+			*h.opts = *h.Buffer
+		}
+		h.opts.SetDefault()
+		h.Env.Buffer = h.opts
+	}
+	if err = h.Plugin.Init(h.Env); err != nil || !isOutputPlugin {
+		return
+	}
+	w := &writer{h, op}
+	if h.Buffer == nil {
+		h.buf = &syncBuffer{w: w, log: h.Env.Log, flushAtShutdown: *h.opts.FlushAtShutdown}
+		return
+	}
+	h.buf, err = buffer.New(h.opts, w, h.Env.Log)
+	return
+}
+
+func (h *Harness) Start() error {
+	return h.Plugin.Start()
+}
+
+// Filter passes the event to the filter plugin. It returns nil if dropped.
+func (h *Harness) Filter(ev *message.Event) (*message.Event, error) {
+	fp, ok := h.Plugin.(plugin.FilterPlugin)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a filter plugin", h.Plugin)
+	}
+	return fp.Filter(ev)
+}
+
+// Push encodes the event by the output plugin, then pushes it into the
+// buffer. Events encoded to nil are dropped.
+func (h *Harness) Push(ev *message.Event) error {
+	op, ok := h.Plugin.(plugin.OutputPlugin)
+	if !ok {
+		return fmt.Errorf("%T is not an output plugin", h.Plugin)
+	}
+	s, err := op.Encode(ev)
+	if err != nil || s == nil {
+		return err
+	}
+	return h.buf.PushWithMetadata(h.opts.Metadata(ev.Tag, ev.Time, ev.Record), s)
+}
+
+// Flush writes the items held by the synchronous buffer, chunk by chunk. It
+// stops at the first failed write, leaving the rest to the next Flush.
+func (h *Harness) Flush() error {
+	b, ok := h.buf.(*syncBuffer)
+	if !ok {
+		return errors.New("Flush needs the synchronous buffer")
+	}
+	return b.flush()
+}
+
+// Close closes the buffer, which tries to write the remaining items once,
+// then closes the plugin.
+func (h *Harness) Close() error {
+	if h.buf != nil {
+		h.buf.Close()
+	}
+	return h.Plugin.Close()
+}
+
+// FailWrites fails the next n writes with the error, or ErrWrite if nil,
+// without calling the plugin.
+func (h *Harness) FailWrites(n int, err error) {
+	if err == nil {
+		err = ErrWrite
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	for i := 0; i < n; i++ {
+		h.failures = append(h.failures, err)
+	}
+}
+
+// Events returns the events emitted by the plugin.
+func (h *Harness) Events() []*message.Event {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return append([]*message.Event(nil), h.events...)
+}
+
+// Ack calls the functions given with events emitted by EmitWithAck, as if
+// outputs wrote the events. It returns the number of the functions called.
+func (h *Harness) Ack() int {
+	h.m.Lock()
+	acks := h.acks
+	h.acks = nil
+	h.m.Unlock()
+	for _, f := range acks {
+		f()
+	}
+	return len(acks)
+}
+
+// Logs returns the messages logged by the plugin at the level, such as
+// "warning", or at all levels if empty.
+func (h *Harness) Logs(level string) []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	var l []string
+	for _, ev := range h.logs {
+		if level == "" || ev.Record["level"] == level {
+			l = append(l, ev.Record["message"].(string))
+		}
+	}
+	return l
+}
+
+// Written returns the items written by the output plugin, in the order of
+// writes.
+func (h *Harness) Written() []buffer.Sizer {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return append([]buffer.Sizer(nil), h.written...)
+}
+
+// Writes returns the number of writes tried, including failed ones.
+func (h *Harness) Writes() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.writes
+}
+
+// WaitEvents waits until the plugin emits n events in total. It reports
+// whether they are emitted within the timeout.
+func (h *Harness) WaitEvents(n int, timeout time.Duration) bool {
+	return h.wait(func() bool { return len(h.events) >= n }, timeout)
+}
+
+// WaitWritten waits until n items are written in total. It reports whether
+// they are written within the timeout.
+func (h *Harness) WaitWritten(n int, timeout time.Duration) bool {
+	return h.wait(func() bool { return len(h.written) >= n }, timeout)
+}
+
+func (h *Harness) wait(f func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		h.m.Lock()
+		ok := f()
+		h.m.Unlock()
+		if ok {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// writer writes items by the output plugin as the framework does, and
+// records them.
+type writer struct {
+	h  *Harness
+	op plugin.OutputPlugin
+}
+
+func (w *writer) Write(l []buffer.Sizer) (int, error) {
+	return w.WriteWithMetadata(nil, l)
+}
+
+// fail counts the write, and returns the error if it's failed by FailWrites.
+func (w *writer) fail() error {
+	w.h.m.Lock()
+	defer w.h.m.Unlock()
+	w.h.writes++
+	if len(w.h.failures) == 0 {
+		return nil
+	}
+	err := w.h.failures[0]
+	w.h.failures = w.h.failures[1:]
+	return err
+}
+
+func (w *writer) WriteWithMetadata(meta *buffer.Metadata, l []buffer.Sizer) (int, error) {
+	if err := w.fail(); err != nil {
+		return 0, err
+	}
+
+	var n int
+	var err error
+	if cw, ok := w.op.(plugin.ChunkWriter); ok {
+		n, err = cw.WriteChunk(meta, l)
+	} else {
+		n, err = w.op.Write(l)
+	}
+	w.h.m.Lock()
+	w.h.written = append(w.h.written, l[:n]...)
+	w.h.m.Unlock()
+	return n, err
+}
+
+// AcceptCompressed passes compressed chunks to the plugin as they are, if the
+// plugin accepts them.
+func (w *writer) AcceptCompressed(format buffer.Compression) bool {
+	cw, ok := w.op.(plugin.CompressedWriter)
+	return ok && cw.AcceptCompressed(format)
+}
+
+// WriteCompressed writes the compressed chunk by the plugin, and records the
+// decompressed items.
+func (w *writer) WriteCompressed(meta *buffer.Metadata, c *buffer.CompressedItem) error {
+	if err := w.fail(); err != nil {
+		return err
+	}
+	if err := w.op.(plugin.CompressedWriter).WriteCompressed(meta, c); err != nil {
+		return err
+	}
+	items, err := c.Items()
+	if err != nil {
+		return err
+	}
+	w.h.m.Lock()
+	w.h.written = append(w.h.written, items...)
+	w.h.m.Unlock()
+	return nil
+}
+
+// syncBuffer holds items in chunks by metadata until flushed.
+type syncBuffer struct {
+	w               *writer
+	log             buffer.Logger
+	flushAtShutdown bool
+	chunks          []*buffer.MemoryChunk
+	m               sync.Mutex
+}
+
+func (b *syncBuffer) Push(s buffer.Sizer) error {
+	return b.PushWithMetadata(nil, s)
+}
+
+func (b *syncBuffer) PushWithMetadata(meta *buffer.Metadata, s buffer.Sizer) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, c := range b.chunks {
+		if c.Metadata.Key() == meta.Key() {
+			c.Push(s)
+			return nil
+		}
+	}
+	c := &buffer.MemoryChunk{Metadata: meta}
+	c.Push(s)
+	b.chunks = append(b.chunks, c)
+	return nil
+}
+
+func (b *syncBuffer) flush() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for len(b.chunks) > 0 {
+		c := b.chunks[0]
+		n, err := b.w.WriteWithMetadata(c.Metadata, c.Items)
+		c.Consume(n)
+		if err != nil {
+			return err
+		}
+		b.chunks = b.chunks[1:]
+	}
+	return nil
+}
+
+func (b *syncBuffer) Stats() *buffer.Stats {
+	b.m.Lock()
+	defer b.m.Unlock()
+	stats := &buffer.Stats{QueuedChunks: len(b.chunks)}
+	for _, c := range b.chunks {
+		stats.TotalSize += c.Size
+	}
+	return stats
+}
+
+func (b *syncBuffer) Usage() float64 {
+	return 0
+}
+
+func (b *syncBuffer) Interrupt() {}
+
+func (b *syncBuffer) Close() {
+	if !b.flushAtShutdown {
+		return
+	}
+	if err := b.flush(); err != nil {
+		b.log.Warningf("Failed to flush at shutdown: %v", err)
+	}
+}
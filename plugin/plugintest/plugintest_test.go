@@ -0,0 +1,79 @@
+package plugintest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+type testOutput struct {
+	env *plugin.Env
+	out []string
+}
+
+func (p *testOutput) Init(env *plugin.Env) error {
+	p.env = env
+	return nil
+}
+
+func (p *testOutput) Start() error { return nil }
+func (p *testOutput) Close() error { return nil }
+
+func (p *testOutput) Encode(ev *message.Event) (buffer.Sizer, error) {
+	if ev.Tag == "drop" {
+		return nil, nil
+	}
+	return buffer.StringItem(ev.Tag), nil
+}
+
+func (p *testOutput) Write(l []buffer.Sizer) (int, error) {
+	for _, s := range l {
+		p.out = append(p.out, string(s.(buffer.StringItem)))
+	}
+	p.env.Log.Infof("%d items written", len(l))
+	return len(l), nil
+}
+
+func TestSyncBuffer(t *testing.T) {
+	p := &testOutput{}
+	h := New(func() plugin.Plugin { return p }, "")
+	assert.NoError(t, h.Init())
+	for _, tag := range []string{"a", "drop", "b"} {
+		assert.NoError(t, h.Push(message.NewEvent(tag, nil)))
+	}
+	h.FailWrites(1, nil)
+	assert.Equal(t, ErrWrite, h.Flush())
+	assert.Nil(t, p.out)
+	assert.NoError(t, h.Flush())
+	assert.Equal(t, []string{"a", "b"}, p.out)
+	assert.Equal(t, []buffer.Sizer{buffer.StringItem("a"), buffer.StringItem("b")}, h.Written())
+	assert.Equal(t, 2, h.Writes())
+	assert.Equal(t, []string{"2 items written"}, h.Logs("info"))
+	assert.Nil(t, h.Logs("warning"))
+
+	// Items left at shutdown are written once
+	assert.NoError(t, h.Push(message.NewEvent("c", nil)))
+	assert.NoError(t, h.Close())
+	assert.Equal(t, []string{"a", "b", "c"}, p.out)
+}
+
+func TestRealBuffer(t *testing.T) {
+	p := &testOutput{}
+	h := New(func() plugin.Plugin { return p }, "")
+	h.Buffer = &buffer.Options{RetryInterval: buffer.Duration(time.Millisecond)}
+	assert.NoError(t, h.Init())
+	assert.Error(t, h.Flush())
+
+	// Failed writes are retried by the buffer
+	err := errors.New("unavailable")
+	h.FailWrites(2, err)
+	assert.NoError(t, h.Push(message.NewEvent("a", nil)))
+	assert.True(t, h.WaitWritten(1, 5*time.Second))
+	assert.Equal(t, 3, h.Writes())
+	assert.NoError(t, h.Close())
+}
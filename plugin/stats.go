@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+// tagCounter counts events by tag prefix, the first part of the tag.
+type tagCounter struct {
+	counts map[string]int64
+	m      sync.Mutex
+}
+
+func (c *tagCounter) add(tag string) {
+	if i := strings.IndexByte(tag, '.'); i >= 0 {
+		tag = tag[:i]
+	}
+	c.m.Lock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[tag]++
+	c.m.Unlock()
+}
+
+func (c *tagCounter) snapshot() map[string]int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (p *plugin) stats() {
+	stats := &message.Stats{}
+	for _, unit := range p.units {
+		stats.Units = append(stats.Units, unit.stats())
+	}
+	p.pipe.Write(&message.Message{Type: message.TypStats, Payload: stats})
+}
+
+func (u *execUnit) stats() *message.UnitStats {
+	stats := &message.UnitStats{
+		ID:           u.ID,
+		Emitted:      atomic.LoadInt64(&u.emitted),
+		Filtered:     atomic.LoadInt64(&u.filtered),
+		Written:      atomic.LoadInt64(&u.written),
+		EventsIn:     u.eventsIn.snapshot(),
+		EventsOut:    u.eventsOut.snapshot(),
+		FilterErrors: atomic.LoadInt64(&u.filterErrors),
+		EncodeErrors: atomic.LoadInt64(&u.encodeErrors),
+	}
+	if r, ok := u.p.(MetricsReporter); ok {
+		stats.Metrics = r.Metrics()
+	}
+	u.m.Lock()
+	if u.buf != nil {
+		stats.Buffer = u.buf.Stats()
+	}
+	u.m.Unlock()
+	return stats
+}
@@ -0,0 +1,92 @@
+// Package sdk is the stable API to write fluxion plugins out of the tree.
+//
+// A plugin is an executable named fluxion-<name>, where the name starts with
+// in-, filter- or out- by its kind. The engine finds it in plugin_dir or PATH,
+// and talks with it through stdin and stdout as described in
+// docs/protocol.md. The main function of the plugin just calls Serve:
+//
+//	func main() {
+//		sdk.Serve("out-example", "1.0.0", func() sdk.Plugin {
+//			return &ExampleOutput{}
+//		})
+//	}
+//
+// Plugins read their config section in Init by ReadConfig. They can be tested
+// without the engine by the plugin/plugintest package.
+package sdk
+
+import (
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+type (
+	// Plugin is implemented by every plugin. Plugins implementing only
+	// Plugin are inputs, which emit events by Env.Emit.
+	Plugin = plugin.Plugin
+	// FilterPlugin modifies or drops events.
+	FilterPlugin = plugin.FilterPlugin
+	// OutputPlugin encodes events into buffer items, then writes them.
+	OutputPlugin = plugin.OutputPlugin
+	// Factory creates a plugin for each config section.
+	Factory = plugin.PluginFactory
+	// Env is given to Plugin.Init.
+	Env = plugin.Env
+	// ConfigSchema is optionally implemented to describe the config.
+	ConfigSchema = plugin.ConfigSchema
+	// MetricsReporter is optionally implemented to report metrics.
+	MetricsReporter = plugin.MetricsReporter
+	// Checker is optionally implemented to validate the config for -check
+	// without the side effects of Init.
+	Checker = plugin.Checker
+
+	Event  = message.Event
+	Metric = message.Metric
+	Sizer  = buffer.Sizer
+	// Duration is decoded from strings such as "10s"
+	Duration = buffer.Duration
+	// Size is decoded from strings such as "8m"
+	Size = buffer.HumanSize
+)
+
+// Defaulter is optionally implemented by configs to fill default values after
+// decoded.
+type Defaulter interface {
+	SetDefault()
+}
+
+// Validator is optionally implemented by configs to check values after
+// defaults are filled.
+type Validator interface {
+	Validate() error
+}
+
+// Serve runs the plugin process until the engine stops it. The version is
+// shown by fluxion -list-plugins, and may be empty.
+func Serve(name, version string, f Factory) {
+	p := plugin.New(name, f)
+	p.Version = version
+	p.Run()
+}
+
+// ReadConfig decodes the config section into v, a pointer to a struct with
+// toml tags. Then defaults are filled and the config is validated if v
+// implements Defaulter and Validator.
+func ReadConfig(env *Env, v interface{}) error {
+	if err := env.ReadConfig(v); err != nil {
+		return err
+	}
+	if d, ok := v.(Defaulter); ok {
+		d.SetDefault()
+	}
+	if val, ok := v.(Validator); ok {
+		return val.Validate()
+	}
+	return nil
+}
+
+// NewEvent returns an event of the current time.
+func NewEvent(tag string, record map[string]interface{}) *Event {
+	return message.NewEvent(tag, record)
+}